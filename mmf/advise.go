@@ -0,0 +1,45 @@
+package mmf
+
+import (
+	"os"
+)
+
+// Advice is a hint to the operating system about how the mapped memory will be
+// accessed (see MappedFile.Advise).
+type Advice int
+
+const (
+	AdviceNormal     Advice = iota // no special treatment
+	AdviceRandom                   // expect page references in random order
+	AdviceSequential               // expect page references in sequential order
+	AdviceWillNeed                 // expect access in the near future
+	AdviceDontNeed                 // do not expect access in the near future
+	AdviceHugePage                 // enable transparent huge pages (Linux only)
+	AdviceNoHugePage               // disable transparent huge pages (Linux only)
+	AdviceFree                     // the content is not needed anymore (Linux only)
+)
+
+// Advise tells the operating system how the given range of the mapped memory
+// will be accessed. The range is extended to page boundaries.
+// On Windows, AdviceWillNeed prefetches the range, AdviceDontNeed discards the
+// range of private mappings, and the other portable advices are ignored.
+// AdviceDontNeed and AdviceFree may discard changes of private and anonymous
+// mappings. Advices that are not supported on the current platform return
+// ErrNotSupported.
+// It returns an error, if any.
+func (mf *MappedFile) Advise(off int64, length int, advice Advice) error {
+	b, err := mf.pageAlignedRange(off, length, "Advise")
+	if err != nil || b == nil {
+		return err
+	}
+	return mf.madvise(b, advice)
+}
+
+// pageRange extends the given range to page boundaries. The end is only
+// rounded up, when it isn't already aligned.
+func pageRange(off int, length int) (int, int) {
+	pagesize := os.Getpagesize()
+	start := off / pagesize * pagesize
+	end := (off + length + pagesize - 1) / pagesize * pagesize
+	return start, end
+}
@@ -0,0 +1,340 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrUnaligned is returned by the atomic operations, when the offset is not
+// aligned to the size of the value (4 bytes for uint32, 8 bytes for uint64).
+var ErrUnaligned = errors.New("MappedFile: unaligned atomic access")
+
+// ErrChecksummedValue is returned by the atomic operations of a BlockFile,
+// that change a value, and by BlockFile.SharedMutexAt and
+// BlockFile.SharedCondAt, when the block-file has checksums
+// (IncompatChecksums). The checksum covers the whole block, so it would not
+// match anymore after the change, and the values change concurrently (even
+// in other processes), so the block can't be sealed reliably.
+var ErrChecksummedValue = errors.New("BlockFile: atomic values can't be changed in a block-file with checksums")
+
+// The atomic operations are done on the mapped memory, so they are atomic
+// across processes, that map the same file with a shared mapping. The value is
+// stored in the byte order of the CPU.
+
+// AtomicUint32At returns a pointer to the uint32 at the given offset, that can
+// be used with the functions of sync/atomic. The pointer is only valid until
+// the mapped memory is moved or unmapped by Truncate or Close (see
+// ReserveAddressSpace), and must not be written to, when the file is mapped
+// read-only.
+// It returns ErrUnaligned, when the offset is not aligned to 4 bytes.
+func (mf *MappedFile) AtomicUint32At(off int64) (*uint32, error) {
+	var p *uint32
+	err := mf.Map(off, 4, func(data []byte) (err error) {
+		p, err = uint32Ptr(data)
+		return err
+	})
+	return p, err
+}
+
+// AtomicUint64At returns a pointer to the uint64 at the given offset, that can
+// be used with the functions of sync/atomic (see AtomicUint32At).
+// It returns ErrUnaligned, when the offset is not aligned to 8 bytes.
+func (mf *MappedFile) AtomicUint64At(off int64) (*uint64, error) {
+	var p *uint64
+	err := mf.Map(off, 8, func(data []byte) (err error) {
+		p, err = uint64Ptr(data)
+		return err
+	})
+	return p, err
+}
+
+// LoadUint32 atomically loads the uint32 at the given offset.
+// It returns an error, if any.
+func (mf *MappedFile) LoadUint32(off int64) (uint32, error) {
+	var val uint32
+	err := mf.Map(off, 4, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			val = atomic.LoadUint32(p)
+		}
+		return err
+	})
+	return val, err
+}
+
+// LoadUint64 atomically loads the uint64 at the given offset.
+// It returns an error, if any.
+func (mf *MappedFile) LoadUint64(off int64) (uint64, error) {
+	var val uint64
+	err := mf.Map(off, 8, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			val = atomic.LoadUint64(p)
+		}
+		return err
+	})
+	return val, err
+}
+
+// StoreUint32 atomically stores the uint32 at the given offset.
+// It returns an error, if any.
+func (mf *MappedFile) StoreUint32(off int64, val uint32) error {
+	if !mf.writable() {
+		return ErrReadOnly
+	}
+	return mf.Map(off, 4, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			atomic.StoreUint32(p, val)
+		}
+		return err
+	})
+}
+
+// StoreUint64 atomically stores the uint64 at the given offset.
+// It returns an error, if any.
+func (mf *MappedFile) StoreUint64(off int64, val uint64) error {
+	if !mf.writable() {
+		return ErrReadOnly
+	}
+	return mf.Map(off, 8, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			atomic.StoreUint64(p, val)
+		}
+		return err
+	})
+}
+
+// CompareAndSwapUint32 atomically replaces the uint32 at the given offset with
+// new, if it is equal to old. It returns true, if the value was swapped.
+func (mf *MappedFile) CompareAndSwapUint32(off int64, old, new uint32) (bool, error) {
+	if !mf.writable() {
+		return false, ErrReadOnly
+	}
+	var swapped bool
+	err := mf.Map(off, 4, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			swapped = atomic.CompareAndSwapUint32(p, old, new)
+		}
+		return err
+	})
+	return swapped, err
+}
+
+// CompareAndSwapUint64 atomically replaces the uint64 at the given offset with
+// new, if it is equal to old. It returns true, if the value was swapped.
+func (mf *MappedFile) CompareAndSwapUint64(off int64, old, new uint64) (bool, error) {
+	if !mf.writable() {
+		return false, ErrReadOnly
+	}
+	var swapped bool
+	err := mf.Map(off, 8, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			swapped = atomic.CompareAndSwapUint64(p, old, new)
+		}
+		return err
+	})
+	return swapped, err
+}
+
+// AddUint32 atomically adds delta to the uint32 at the given offset, and
+// returns the new value. To subtract c, use ^uint32(c-1) as delta.
+func (mf *MappedFile) AddUint32(off int64, delta uint32) (uint32, error) {
+	if !mf.writable() {
+		return 0, ErrReadOnly
+	}
+	var val uint32
+	err := mf.Map(off, 4, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			val = atomic.AddUint32(p, delta)
+		}
+		return err
+	})
+	return val, err
+}
+
+// AddUint64 atomically adds delta to the uint64 at the given offset, and
+// returns the new value. To subtract c, use ^uint64(c-1) as delta.
+func (mf *MappedFile) AddUint64(off int64, delta uint64) (uint64, error) {
+	if !mf.writable() {
+		return 0, ErrReadOnly
+	}
+	var val uint64
+	err := mf.Map(off, 8, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			val = atomic.AddUint64(p, delta)
+		}
+		return err
+	})
+	return val, err
+}
+
+// writable returns false, when the mapped memory can't be written to. A
+// closed MappedFile is reported by Map.
+func (mf *MappedFile) writable() bool {
+	return mf == nil || mf.data == nil || mf.prot&ProtWrite != 0
+}
+
+// uint32Ptr returns a pointer to the first 4 bytes of the slice.
+func uint32Ptr(data []byte) (*uint32, error) {
+	p := unsafe.Pointer(&data[0])
+	if uintptr(p)%4 != 0 {
+		return nil, ErrUnaligned
+	}
+	return (*uint32)(p), nil
+}
+
+// uint64Ptr returns a pointer to the first 8 bytes of the slice. The 64-bit
+// atomic operations require an alignment of 8 bytes on all platforms.
+func uint64Ptr(data []byte) (*uint64, error) {
+	p := unsafe.Pointer(&data[0])
+	if uintptr(p)%8 != 0 {
+		return nil, ErrUnaligned
+	}
+	return (*uint64)(p), nil
+}
+
+// The atomic operations of a BlockFile work on the value at the given offset
+// inside of the given block (block-index 0 is the header block, which can't
+// be used). There are no pointer accessors like MappedFile.AtomicUint32At,
+// because a pointer would be invalidated, when AllocateBlock grows the Mapper.
+// With IncompatChecksums, the values can only be loaded (see
+// ErrChecksummedValue).
+
+// LoadUint32 atomically loads the uint32 at the given offset in the block.
+// It returns an error, if any.
+func (bf *BlockFile) LoadUint32(block int, off int) (uint32, error) {
+	var val uint32
+	err := bf.mapValue(block, off, 4, false, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			val = atomic.LoadUint32(p)
+		}
+		return err
+	})
+	return val, err
+}
+
+// LoadUint64 atomically loads the uint64 at the given offset in the block.
+// It returns an error, if any.
+func (bf *BlockFile) LoadUint64(block int, off int) (uint64, error) {
+	var val uint64
+	err := bf.mapValue(block, off, 8, false, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			val = atomic.LoadUint64(p)
+		}
+		return err
+	})
+	return val, err
+}
+
+// StoreUint32 atomically stores the uint32 at the given offset in the block.
+// It returns an error, if any.
+func (bf *BlockFile) StoreUint32(block int, off int, val uint32) error {
+	return bf.mapValue(block, off, 4, true, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			atomic.StoreUint32(p, val)
+		}
+		return err
+	})
+}
+
+// StoreUint64 atomically stores the uint64 at the given offset in the block.
+// It returns an error, if any.
+func (bf *BlockFile) StoreUint64(block int, off int, val uint64) error {
+	return bf.mapValue(block, off, 8, true, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			atomic.StoreUint64(p, val)
+		}
+		return err
+	})
+}
+
+// CompareAndSwapUint32 atomically replaces the uint32 at the given offset in
+// the block with new, if it is equal to old. It returns true, if the value was
+// swapped.
+func (bf *BlockFile) CompareAndSwapUint32(block int, off int, old, new uint32) (bool, error) {
+	var swapped bool
+	err := bf.mapValue(block, off, 4, true, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			swapped = atomic.CompareAndSwapUint32(p, old, new)
+		}
+		return err
+	})
+	return swapped, err
+}
+
+// CompareAndSwapUint64 atomically replaces the uint64 at the given offset in
+// the block with new, if it is equal to old. It returns true, if the value was
+// swapped.
+func (bf *BlockFile) CompareAndSwapUint64(block int, off int, old, new uint64) (bool, error) {
+	var swapped bool
+	err := bf.mapValue(block, off, 8, true, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			swapped = atomic.CompareAndSwapUint64(p, old, new)
+		}
+		return err
+	})
+	return swapped, err
+}
+
+// AddUint32 atomically adds delta to the uint32 at the given offset in the
+// block, and returns the new value.
+func (bf *BlockFile) AddUint32(block int, off int, delta uint32) (uint32, error) {
+	var val uint32
+	err := bf.mapValue(block, off, 4, true, func(data []byte) error {
+		p, err := uint32Ptr(data)
+		if err == nil {
+			val = atomic.AddUint32(p, delta)
+		}
+		return err
+	})
+	return val, err
+}
+
+// AddUint64 atomically adds delta to the uint64 at the given offset in the
+// block, and returns the new value.
+func (bf *BlockFile) AddUint64(block int, off int, delta uint64) (uint64, error) {
+	var val uint64
+	err := bf.mapValue(block, off, 8, true, func(data []byte) error {
+		p, err := uint64Ptr(data)
+		if err == nil {
+			val = atomic.AddUint64(p, delta)
+		}
+		return err
+	})
+	return val, err
+}
+
+// mapValue maps the value of the given size at the given offset in the block.
+func (bf *BlockFile) mapValue(block int, off int, size int, write bool, handler func([]byte) error) error {
+	if write && bf.readOnly {
+		return ErrReadOnly
+	}
+	if write && bf.checksumSize() != 0 {
+		return ErrChecksummedValue
+	}
+	if write && bf.hasShadowPaging() {
+		return ErrShadowPaging
+	}
+	if off < 0 || off > bf.BlockDataSize()-size {
+		return fmt.Errorf("invalid offset %d in block %d", off, block)
+	}
+	// the values are loaded without verifying the checksum, like in other
+	// block-files, which may change them concurrently
+	return bf.mapBlock(block, false, write, func(data []byte) error {
+		return handler(data[off : off+size])
+	})
+}
@@ -0,0 +1,536 @@
+package mmf
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ContentBitmap is the content type of the blocks, that hold the free-space
+// bitmap (see WithBitmapAllocator).
+const ContentBitmap uint32 = 0xB17B10C5
+
+// With IncompatBitmapAllocator, the free blocks are marked in a bitmap,
+// instead of being linked in the free-list. The bitmap is stored in dedicated
+// blocks: nextFree of the header block is the first bitmap block, and the
+// bitmap blocks are linked by their nextFree. After the header of a block:
+//
+//	20 freeCount uint32 // the number of bits, that are set
+//	24 bitmap           // a set bit marks a free block
+//
+// Bit i of the n-th bitmap block (bit i%8 of byte i/8) stands for the block
+// n*bitsPerBitmap+i. Bitmap blocks are only added, when a block is freed,
+// that is not covered yet, so blocks after the last bitmap block are in use.
+const (
+	bmFreeCountOffset = 20
+	bmDataOffset      = 24
+)
+
+// WithBitmapAllocator creates a block-file, that keeps track of the free
+// blocks in a bitmap (see IncompatBitmapAllocator), instead of the linked
+// free-list. IsFree is O(1), FreeCount maps only the bitmap blocks, and
+// AllocateRun can reuse freed blocks. Freed blocks are not written to.
+// Existing block-files can be converted by ConvertToBitmapAllocator.
+func WithBitmapAllocator() Option {
+	return func(o *options) {
+		o.incompatFeatures |= IncompatBitmapAllocator
+	}
+}
+
+// hasBitmap returns true, when the block-file uses the bitmap allocator.
+func (bf *BlockFile) hasBitmap() bool {
+	return bf.incompat&IncompatBitmapAllocator != 0
+}
+
+// bitsPerBitmap returns the number of blocks, that are covered by a bitmap
+// block.
+func (bf *BlockFile) bitsPerBitmap() int {
+	return (int(bf.blocksize) - bmDataOffset - bf.checksumSize()) * 8
+}
+
+// bitmapsOf returns the bitmap blocks, that are seen through the given
+// mapper: the ones of the transaction for a WALTx, and bf.bitmaps otherwise.
+// The lock must be held.
+func (bf *BlockFile) bitmapsOf(raw rawBlockMapper) *[]int {
+	if tx, ok := raw.(*WALTx); ok {
+		return tx.bitmapBlocks()
+	}
+	return &bf.bitmaps
+}
+
+// loadBitmaps reads the list of bitmap blocks from the block-file.
+func (bf *BlockFile) loadBitmaps(raw rawBlockMapper) error {
+	var next, highWater uint64
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) error {
+		next, highWater = hdr.nextFree(), hdr.highWater()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var blocks []int
+	for next != 0 {
+		if next >= highWater || uint64(len(blocks)) >= highWater {
+			return fmt.Errorf("BlockFile: invalid bitmap block %d", next)
+		}
+		block, err := bf.blockIndex(next)
+		if err != nil {
+			return err
+		}
+		err = bf.mapHeaderBlock(raw, block, func(hdr *bfHeader) error {
+			if hdr.contentType() != ContentBitmap {
+				return fmt.Errorf("BlockFile: block %d is not a bitmap block", block)
+			}
+			next = hdr.nextFree()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+	*bf.bitmapsOf(raw) = blocks
+	return nil
+}
+
+// mapBitmap maps the n-th bitmap block, and calls the handler with its header
+// and bitmap. With update, the block is sealed afterwards.
+func (bf *BlockFile) mapBitmap(raw rawBlockMapper, n int, update bool, handler func(hdr *bfHeader, bitmap []byte) error) error {
+	block := (*bf.bitmapsOf(raw))[n]
+	mapHeader := bf.mapHeaderBlock
+	if update {
+		mapHeader = bf.updateHeaderBlock
+	}
+	return mapHeader(raw, block, func(hdr *bfHeader) error {
+		if hdr.contentType() != ContentBitmap {
+			return fmt.Errorf("BlockFile: block %d is not a bitmap block", block)
+		}
+		return handler(hdr, hdr.data[bmDataOffset:len(hdr.data)-bf.checksumSize()])
+	})
+}
+
+// appendBitmap adds a new (empty) bitmap block after the high-water mark.
+func (bf *BlockFile) appendBitmap(raw rawBlockMapper) error {
+	block, err := bf.allocateNewBlocks(raw, 1)
+	if err != nil {
+		return err
+	}
+	err = bf.initHeaderBlock(raw, block, func(hdr *bfHeader) error {
+		hdr.setContentType(ContentBitmap)
+		for i := range hdr.data[bmFreeCountOffset:] {
+			hdr.data[bmFreeCountOffset+i] = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bitmaps := bf.bitmapsOf(raw)
+	prev := 0
+	if len(*bitmaps) > 0 {
+		prev = (*bitmaps)[len(*bitmaps)-1]
+	}
+	err = bf.updateHeaderBlock(raw, prev, func(hdr *bfHeader) error {
+		hdr.setNextFree(uint64(block))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*bitmaps = append(*bitmaps, block)
+	return nil
+}
+
+// isFreeBit returns true, when the given block is marked as free in the
+// bitmap.
+func (bf *BlockFile) isFreeBit(raw rawBlockMapper, block int) (bool, error) {
+	per := bf.bitsPerBitmap()
+	n, i := block/per, block%per
+	if n >= len(*bf.bitmapsOf(raw)) {
+		return false, nil
+	}
+	var free bool
+	err := bf.mapBitmap(raw, n, false, func(hdr *bfHeader, bitmap []byte) error {
+		free = bitmap[i/8]&(1<<uint(i%8)) != 0
+		return nil
+	})
+	return free, err
+}
+
+// freeBitmapBlock marks the given block as free in the bitmap, and adds
+// bitmap blocks, when it isn't covered yet.
+func (bf *BlockFile) freeBitmapBlock(raw rawBlockMapper, block int) error {
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) error {
+		if block <= 0 || uint64(block) >= hdr.highWater() {
+			return fmt.Errorf("block %d is not allocated", block)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, bitmap := range *bf.bitmapsOf(raw) {
+		if block == bitmap {
+			return fmt.Errorf("block %d is a bitmap block", block)
+		}
+	}
+	per := bf.bitsPerBitmap()
+	n, i := block/per, block%per
+	for n >= len(*bf.bitmapsOf(raw)) {
+		if err := bf.appendBitmap(raw); err != nil {
+			return err
+		}
+	}
+	return bf.mapBitmap(raw, n, true, func(hdr *bfHeader, bitmap []byte) error {
+		if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			return fmt.Errorf("block %d is already free", block)
+		}
+		bitmap[i/8] |= 1 << uint(i%8)
+		hdr.setUint32At(bmFreeCountOffset, hdr.uint32At(bmFreeCountOffset)+1)
+		return nil
+	})
+}
+
+// allocateBitmapBlocks allocates the given number of blocks. Free blocks in
+// the bitmap are used first (the lowest first).
+func (bf *BlockFile) allocateBitmapBlocks(raw rawBlockMapper, num int) ([]int, error) {
+	blocks := make([]int, 0, num)
+	per := bf.bitsPerBitmap()
+	for n := 0; n < len(*bf.bitmapsOf(raw)) && len(blocks) < num; n++ {
+		// full bitmap blocks are not mapped for update, so they are neither
+		// rewritten nor logged
+		var count uint32
+		err := bf.mapBitmap(raw, n, false, func(hdr *bfHeader, bitmap []byte) error {
+			count = hdr.uint32At(bmFreeCountOffset)
+			return nil
+		})
+		if err != nil {
+			return blocks, err
+		}
+		if count == 0 {
+			continue
+		}
+		err = bf.mapBitmap(raw, n, true, func(hdr *bfHeader, bitmap []byte) error {
+			count := hdr.uint32At(bmFreeCountOffset)
+			for i := 0; i < len(bitmap) && count > 0 && len(blocks) < num; i++ {
+				for bitmap[i] != 0 && len(blocks) < num {
+					bit := bits.TrailingZeros8(bitmap[i])
+					bitmap[i] &^= 1 << uint(bit)
+					count--
+					blocks = append(blocks, n*per+i*8+bit)
+				}
+			}
+			hdr.setUint32At(bmFreeCountOffset, count)
+			return nil
+		})
+		if err != nil {
+			return blocks, err
+		}
+	}
+	if n := num - len(blocks); n > 0 {
+		first, err := bf.allocateNewBlocks(raw, n)
+		if err != nil {
+			return blocks, err
+		}
+		for i := 0; i < n; i++ {
+			blocks = append(blocks, first+i)
+		}
+	}
+	return blocks, nil
+}
+
+// clearBits marks the given range of blocks as used in the bitmap.
+func (bf *BlockFile) clearBits(raw rawBlockMapper, first int, num int) error {
+	per := bf.bitsPerBitmap()
+	for num > 0 {
+		n, i := first/per, first%per
+		err := bf.mapBitmap(raw, n, true, func(hdr *bfHeader, bitmap []byte) error {
+			count := hdr.uint32At(bmFreeCountOffset)
+			for ; i < per && num > 0; i++ {
+				bitmap[i/8] &^= 1 << uint(i%8)
+				count--
+				first++
+				num--
+			}
+			hdr.setUint32At(bmFreeCountOffset, count)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateRun allocates the given number of contiguous blocks, and returns
+// the index of the first block. Without the bitmap allocator, the blocks are
+// always allocated after the high-water mark.
+func (bf *BlockFile) allocateRun(raw rawBlockMapper, num int) (int, error) {
+	if num <= 0 {
+		return 0, fmt.Errorf("BlockFile: invalid number of blocks %d", num)
+	}
+	if !bf.hasBitmap() {
+		return bf.allocateNewBlocks(raw, num)
+	}
+	var highWater int
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) (err error) {
+		highWater, err = bf.blockIndex(hdr.highWater())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	per := bf.bitsPerBitmap()
+	start, length := 0, 0
+	for n := 0; n < len(*bf.bitmapsOf(raw)) && length < num; n++ {
+		err := bf.mapBitmap(raw, n, false, func(hdr *bfHeader, bitmap []byte) error {
+			if hdr.uint32At(bmFreeCountOffset) == 0 {
+				length = 0
+				return nil
+			}
+			for i := 0; i < per && n*per+i < highWater && length < num; i++ {
+				if bitmap[i/8] == 0 && i%8 == 0 {
+					length = 0
+					i += 7
+				} else if bitmap[i/8]&(1<<uint(i%8)) == 0 {
+					length = 0
+				} else {
+					if length == 0 {
+						start = n*per + i
+					}
+					length++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if length < num && (length == 0 || start+length != highWater) {
+		// the run can't be extended after the high-water mark
+		return bf.allocateNewBlocks(raw, num)
+	}
+	if length < num {
+		if _, err := bf.allocateNewBlocks(raw, num-length); err != nil {
+			return 0, err
+		}
+	}
+	if err := bf.clearBits(raw, start, length); err != nil {
+		return 0, err
+	}
+	return start, nil
+}
+
+// IsFree returns true, when the given block is free (it is in the free-list
+// or is marked as free in the bitmap). With the bitmap allocator, this takes
+// a single Map, otherwise the free-list is walked.
+// It returns an error, if any.
+func (bf *BlockFile) IsFree(block int) (bool, error) {
+	if block < 0 {
+		return false, fmt.Errorf("invalid block index %d", block)
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	if bf.hasBitmap() {
+		return bf.isFreeBit(bf, block)
+	}
+	free := false
+	err := bf.walkFreeList(bf, func(b int) bool {
+		free = b == block
+		return !free
+	})
+	return free, err
+}
+
+// FreeCount returns the number of free blocks. With the bitmap allocator, the
+// count is stored in each bitmap block, otherwise the free-list is walked.
+// It returns an error, if any.
+func (bf *BlockFile) FreeCount() (int, error) {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	count := 0
+	if bf.hasBitmap() {
+		for n := range bf.bitmaps {
+			err := bf.mapBitmap(bf, n, false, func(hdr *bfHeader, bitmap []byte) error {
+				count += int(hdr.uint32At(bmFreeCountOffset))
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+		return count, nil
+	}
+	err := bf.walkFreeList(bf, func(int) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// AllocateRun allocates the given number of contiguous blocks, and returns
+// the index of the first block (see AllocateBlock). With the bitmap
+// allocator, the first run of free blocks, that is long enough, is used.
+// Without it, or when there is no such run, the blocks are allocated after
+// the high-water mark.
+func (bf *BlockFile) AllocateRun(num int) (int, error) {
+	if bf.readOnly {
+		return 0, ErrReadOnly
+	}
+	if bf.hasShadowPaging() {
+		return 0, ErrShadowPaging
+	}
+	if bf.hasWAL() {
+		return bf.allocateRunLogged(num)
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.allocateRun(bf, num)
+}
+
+// walkFreeList calls the handler for each block in the free-list, until it
+// returns false.
+func (bf *BlockFile) walkFreeList(raw rawBlockMapper, handler func(block int) bool) error {
+	var next, highWater uint64
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) error {
+		next, highWater = hdr.nextFree(), hdr.highWater()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for n := uint64(0); next != 0; n++ {
+		if next >= highWater || n >= highWater {
+			return fmt.Errorf("BlockFile: invalid block %d in the free-list", next)
+		}
+		block, err := bf.blockIndex(next)
+		if err != nil {
+			return err
+		}
+		err = bf.mapHeaderBlock(raw, block, func(hdr *bfHeader) error {
+			if hdr.contentType() != ContentFreeList {
+				return fmt.Errorf("block %d is not marked as free", block)
+			}
+			next = hdr.nextFree()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !handler(block) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ConvertToBitmapAllocator converts the block-file that is given as filename
+// in place to the bitmap allocator (see ConvertToBitmapAllocatorInMapper).
+// A committed transaction in its write-ahead log is replayed before.
+// It returns an error, if any.
+func ConvertToBitmapAllocator(filename string) error {
+	bf, err := OpenBlockFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := bf.convertToBitmap(); err != nil {
+		bf.Close()
+		return err
+	}
+	return bf.Close()
+}
+
+// ConvertToBitmapAllocatorInMapper converts the block-file in the given Mapper
+// in place from the linked free-list to the bitmap allocator (see
+// WithBitmapAllocator). The blocks in the free-list are marked as free in new
+// bitmap blocks, which are allocated after the high-water mark. The header
+// block is changed last, so when the conversion is interrupted, the file still
+// uses the free-list, and only the new blocks are lost. Files, that already
+// use the bitmap allocator, are left unchanged. Files of version 1 have to
+// be migrated by UpgradeBlockFile before (see ErrOldFormat).
+// It returns an error, if any.
+func ConvertToBitmapAllocatorInMapper(mapper Mapper) error {
+	bf, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		return err
+	}
+	return bf.convertToBitmap()
+}
+
+func (bf *BlockFile) convertToBitmap() error {
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+	if bf.version == 1 {
+		return ErrOldFormat
+	}
+	if bf.hasShadowPaging() {
+		return ErrShadowPaging
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.hasBitmap() {
+		return nil
+	}
+	// the free blocks, grouped by their bitmap block
+	var groups [][]int
+	per := bf.bitsPerBitmap()
+	err := bf.walkFreeList(bf, func(block int) bool {
+		for len(groups) <= block/per {
+			groups = append(groups, nil)
+		}
+		groups[block/per] = append(groups[block/per], block%per)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	var bitmaps []int
+	if num := len(groups); num > 0 {
+		first, err := bf.allocateNewBlocks(bf, num)
+		if err != nil {
+			return err
+		}
+		for n := 0; n < num; n++ {
+			bitmaps = append(bitmaps, first+n)
+			err := bf.initHeaderBlock(bf, first+n, func(hdr *bfHeader) error {
+				hdr.setContentType(ContentBitmap)
+				if n+1 < num {
+					hdr.setNextFree(uint64(first + n + 1))
+				}
+				bitmap := hdr.data[bmDataOffset : len(hdr.data)-bf.checksumSize()]
+				for i := range hdr.data[bmFreeCountOffset:] {
+					hdr.data[bmFreeCountOffset+i] = 0
+				}
+				for _, i := range groups[n] {
+					if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+						return fmt.Errorf("block %d is twice in the free-list", n*per+i)
+					}
+					bitmap[i/8] |= 1 << uint(i%8)
+				}
+				hdr.setUint32At(bmFreeCountOffset, uint32(len(groups[n])))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err := syncMapperRange(bf.mapper, int64(first+n)*int64(bf.blocksize), int(bf.blocksize)); err != nil {
+				return err
+			}
+		}
+	}
+	err = bf.updateFileHeader(bf, func(hdr *bfFileHeader) error {
+		hdr.setNextFree(0)
+		if len(bitmaps) > 0 {
+			hdr.setNextFree(uint64(bitmaps[0]))
+		}
+		hdr.setUint32At(bfIncompatFeaturesOffset, hdr.incompatFeatures()|IncompatBitmapAllocator)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bf.incompat |= IncompatBitmapAllocator
+	bf.bitmaps = bitmaps
+	return nil
+}
@@ -0,0 +1,253 @@
+package mmf_test
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func checkFree(bf *BlockFile, block int, expected bool, t *testing.T) {
+	free, err := bf.IsFree(block)
+	if err != nil {
+		t.Fatal("Error while checking block", block, err)
+	}
+	if free != expected {
+		t.Error("IsFree of block", block, "returned", free, "expected", expected)
+	}
+}
+
+func checkFreeCount(bf *BlockFile, expected int, t *testing.T) {
+	count, err := bf.FreeCount()
+	if err != nil {
+		t.Fatal("Error while counting free blocks:", err)
+	}
+	if count != expected {
+		t.Error("FreeCount returned", count, "expected", expected)
+	}
+}
+
+func TestBitmapAllocator(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 64, WithBitmapAllocator(), WithChecksums())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, incompat := bf.Features(); incompat&IncompatBitmapAllocator == 0 {
+		t.Error("expected IncompatBitmapAllocator, got", incompat)
+	}
+	if _, err := bf.AllocateBlocks(10); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if _, err := bf.FreeBlocks([]int{3, 4, 5, 8}); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+	// the first bitmap block is allocated by the first FreeBlock
+	if err := bf.FreeBlock(11); err == nil {
+		t.Error("expected an error when freeing a bitmap block")
+	}
+	if err := bf.FreeBlock(4); err == nil {
+		t.Error("expected an error when freeing a free block")
+	}
+	checkFree(bf, 4, true, t)
+	checkFree(bf, 6, false, t)
+	checkFree(bf, 100, false, t)
+	checkFreeCount(bf, 4, t)
+
+	first, err := bf.AllocateRun(3)
+	if err != nil {
+		t.Fatal("Error while allocating run:", err)
+	}
+	if first != 3 {
+		t.Error("AllocateRun returned", first, "expected 3")
+	}
+	checkFreeCount(bf, 1, t)
+	if block, err := bf.AllocateBlock(); err != nil || block != 8 {
+		t.Error("AllocateBlock returned", block, err, "expected 8")
+	}
+	checkFreeCount(bf, 0, t)
+
+	// a run at the end is extended after the high-water mark
+	if _, err := bf.AllocateBlocks(4); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if _, err := bf.FreeBlocks([]int{14, 15}); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+	if first, err := bf.AllocateRun(4); err != nil || first != 14 {
+		t.Error("AllocateRun returned", first, err, "expected 14")
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 18 {
+		t.Error("NumBlocks returned", n, err, "expected 18")
+	}
+
+	// blocks in more than one bitmap block (320 blocks per bitmap block)
+	blocks, err := bf.AllocateBlocks(700)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	for i := 0; i < len(blocks); i += 2 {
+		if err := bf.FreeBlock(blocks[i]); err != nil {
+			t.Fatal("Error while freeing block:", err)
+		}
+	}
+	checkFreeCount(bf, 350, t)
+
+	reopened, err := OpenBlockFileFromMapper(NewMemoryMapperFromBytes(mapper.Bytes()))
+	if err != nil {
+		t.Fatal("Error while reopening block file:", err)
+	}
+	reopened.SetVerifyChecksums(true)
+	checkFreeCount(reopened, 350, t)
+	checkFree(reopened, blocks[0], true, t)
+	checkFree(reopened, blocks[1], false, t)
+	checkFree(reopened, blocks[698], true, t)
+	allocated, err := reopened.AllocateBlocks(2)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if allocated[0] != blocks[0] || allocated[1] != blocks[2] {
+		t.Error("AllocateBlocks returned", allocated, "expected the lowest free blocks")
+	}
+	closeBF(reopened, t)
+	closeBF(bf, t)
+}
+
+func TestBitmapAllocateRun(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 64, WithBitmapAllocator(), WithChecksums())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := bf.AllocateBlocks(400); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	// a run, that is too short, and a run, that spans two bitmap blocks (320
+	// blocks per bitmap block)
+	free := []int{10, 11}
+	for block := 316; block < 325; block++ {
+		free = append(free, block)
+	}
+	if _, err := bf.FreeBlocks(free); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+	if first, err := bf.AllocateRun(6); err != nil || first != 316 {
+		t.Error("AllocateRun returned", first, err, "expected 316")
+	}
+	checkFreeCount(bf, 5, t)
+	reopened, err := OpenBlockFileFromMapper(NewMemoryMapperFromBytes(mapper.Bytes()))
+	if err != nil {
+		t.Fatal("Error while reopening block file:", err)
+	}
+	reopened.SetVerifyChecksums(true)
+	checkFreeCount(reopened, 5, t)
+	checkFree(reopened, 319, false, t)
+	checkFree(reopened, 321, false, t)
+	checkFree(reopened, 322, true, t)
+	closeBF(reopened, t)
+
+	// a run at the end is extended after the high-water mark (the bitmap
+	// blocks are 401 and 402, so the 5 free blocks and 403 to 405 are used)
+	if _, err := bf.AllocateBlocks(8); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 406 {
+		t.Error("NumBlocks returned", n, err, "expected 406")
+	}
+	if _, err := bf.FreeBlocks([]int{403, 404, 405}); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+	if first, err := bf.AllocateRun(5); err != nil || first != 403 {
+		t.Error("AllocateRun returned", first, err, "expected 403")
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 408 {
+		t.Error("NumBlocks returned", n, err, "expected 408")
+	}
+	checkFreeCount(bf, 0, t)
+	checkFree(bf, 405, false, t)
+	checkFree(bf, 407, false, t)
+	closeBF(bf, t)
+}
+
+func TestConvertToBitmapAllocator(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 64, LargeBlockIndices())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := bf.AllocateBlocks(6); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if _, err := bf.FreeBlocks([]int{2, 4}); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+	// without the bitmap allocator, the free-list is walked
+	checkFree(bf, 2, true, t)
+	checkFree(bf, 3, false, t)
+	checkFreeCount(bf, 2, t)
+	if first, err := bf.AllocateRun(2); err != nil || first != 7 {
+		t.Error("AllocateRun returned", first, err, "expected 7")
+	}
+	closeBF(bf, t)
+
+	if err := ConvertToBitmapAllocatorInMapper(mapper); err != nil {
+		t.Fatal("Error while converting block file:", err)
+	}
+	if err := ConvertToBitmapAllocatorInMapper(mapper); err != nil {
+		t.Fatal("Error while converting converted block file:", err)
+	}
+	bf, err = OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening converted block file:", err)
+	}
+	if _, incompat := bf.Features(); incompat&IncompatBitmapAllocator == 0 {
+		t.Error("expected IncompatBitmapAllocator, got", incompat)
+	}
+	checkFree(bf, 2, true, t)
+	checkFree(bf, 3, false, t)
+	checkFree(bf, 4, true, t)
+	checkFreeCount(bf, 2, t)
+	if block, err := bf.AllocateBlock(); err != nil || block != 2 {
+		t.Error("AllocateBlock returned", block, err, "expected 2")
+	}
+	checkFreeCount(bf, 1, t)
+	closeBF(bf, t)
+}
+
+func TestBitmapAllocatorWithWAL(t *testing.T) {
+	const filename = "bftest12.tmp"
+	defer os.Remove(filename)
+	defer os.Remove(filename + WALSuffix)
+	bf, err := CreateBlockFileWithOptions(filename, 64, WithWAL(), WithBitmapAllocator())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := bf.AllocateBlocks(4); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	// the bitmap block of a rolled back transaction is not used
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if err := tx.FreeBlock(2); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	tx.Rollback()
+	checkFree(bf, 2, false, t)
+	checkFreeCount(bf, 0, t)
+
+	if err := bf.FreeBlock(3); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	checkFree(bf, 3, true, t)
+	closeBF(bf, t)
+
+	bf, err = OpenBlockFile(filename)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	checkFree(bf, 3, true, t)
+	checkFreeCount(bf, 1, t)
+	closeBF(bf, t)
+}
@@ -1,18 +1,26 @@
 package mmf
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"reflect"
+	"math"
 	"runtime"
-	"unsafe"
+	"sync"
 )
 
 // The default block size that is used by CreateBlockFile and CreateBlockFileInMapper
 const DefaultBlocksize = 4096
 
-const BlockFileMagic uint32 = 0xB10CF11E         // the first 4 byte of a block-file
-const reversedBlockFileMagic uint32 = 0x1EF10CB1 // used to check the endianes
+const BlockFileMagic uint32 = 0xB10CF11E  // the first 4 byte of the blocks in the free-list, and of block-files of version 1
+const BlockFileMagic2 uint32 = 0xB10CF12E // the first 4 byte of a block-file (since version 2)
+
+// BlockFileVersion is the version of the format of the block-files, that are
+// created by this package. Files of version 1 can still be opened, but they
+// don't support any features (see ErrOldFormat). They can be migrated by
+// UpgradeBlockFile.
+const BlockFileVersion = 2
 
 const ContentFreeList uint32 = 0xF9337157
 
@@ -23,81 +31,423 @@ type Mapper interface {
 	Truncate(size int64) error
 }
 
+// The headers are stored in the byte order, in which the magic number of the
+// file is written. New files are created in little endian byte order, but
+// files in big endian byte order (like files, that were created on big endian
+// platforms by earlier versions) can be read and written as well.
+//
+// The header of a block (header block and blocks in the free-list):
+//
+//	0  magic       uint32
+//	4  contentType uint32
+//	8  blocksize   uint32
+//	12 nextFree    uint32
+//
+// The header block (index 0) starts with BlockFileMagic2, and extends it with:
+//
+//	16 highWater        uint32 // the number of blocks that were handed out (including the header block)
+//	20 version          uint32 // BlockFileVersion
+//	24 compatFeatures   uint32 // features, that can be ignored by older versions
+//	28 incompatFeatures uint32 // features, that older versions must not open
+//
+// With IncompatLargeIndex, the block indices are 64 bit wide. The upper 32
+// bits are stored separately, so the layout above stays the same:
+//
+//	16 nextFreeHigh  uint32 // in the blocks in the free-list
+//	32 highWaterHigh uint32 // in the header block
+//	36 nextFreeHigh  uint32 // in the header block
+//
+// With IncompatChecksums, the last 4 bytes of each block hold its checksum
+// (see SealBlock).
+//
+// With IncompatBitmapAllocator, nextFree of the header block is the first
+// block of the free-space bitmap, instead of the first block in the free-list.
+//
+// In version 1, the header block had no extended header: it started with
+// BlockFileMagic, and the data section followed directly. There was no
+// high-water mark either, all blocks up to the end of the file were handed out.
+const (
+	bfMagicOffset            = 0
+	bfContentTypeOffset      = 4
+	bfBlocksizeOffset        = 8
+	bfNextFreeOffset         = 12
+	bfHighWaterOffset        = 16
+	bfVersionOffset          = 20
+	bfCompatFeaturesOffset   = 24
+	bfIncompatFeaturesOffset = 28
+
+	bfBlockNextFreeHighOffset = 16
+	bfHighWaterHighOffset     = 32
+	bfNextFreeHighOffset      = 36
+)
+
+var bfHeaderSize int = 16
+
+var bfFileHeaderSize int = 32
+
+var bfLargeFileHeaderSize int = 40
+
+// The incompatible feature flags of a block-file (see BlockFile.Features).
+const (
+	// IncompatLargeIndex uses 64-bit block indices, instead of 32-bit block
+	// indices (see LargeBlockIndices).
+	IncompatLargeIndex uint32 = 1 << iota
+	// IncompatChecksums stores a checksum at the end of each block (see
+	// WithChecksums and SealBlock).
+	IncompatChecksums
+	// IncompatShadowPaging stores the meta slots for shadow-paging
+	// transactions in the header block (see WithShadowPaging and Begin).
+	IncompatShadowPaging
+	// IncompatBitmapAllocator keeps track of the free blocks in a bitmap,
+	// instead of the free-list (see WithBitmapAllocator).
+	IncompatBitmapAllocator
+)
+
+// The feature flags, that are supported by this package (see
+// UnsupportedFeaturesError).
+const (
+	supportedCompatFeatures   uint32 = 0
+	supportedIncompatFeatures uint32 = IncompatLargeIndex | IncompatChecksums | IncompatShadowPaging | IncompatBitmapAllocator
+)
+
+// ErrBlockIndexOverflow is returned, when a block-index does not fit into
+// the format of the block-file (32 bits without IncompatLargeIndex), or into
+// an int or the size of the Mapper.
+var ErrBlockIndexOverflow = errors.New("BlockFile: block index overflow")
+
+// bfHeader gives access to the header at the beginning of a block.
 type bfHeader struct {
-	magic       uint32
-	contentType uint32
-	blocksize   uint32
-	nextFree    uint32
+	data         []byte
+	order        binary.ByteOrder
+	nextFreeHigh int // the offset of the upper 32 bits of nextFree, or 0 for 32-bit block indices
 }
 
-var bfHeaderSize int = 16
+func (hdr *bfHeader) uint32At(off int) uint32 {
+	return hdr.order.Uint32(hdr.data[off : off+4])
+}
+
+func (hdr *bfHeader) setUint32At(off int, val uint32) {
+	hdr.order.PutUint32(hdr.data[off:off+4], val)
+}
+
+func (hdr *bfHeader) magic() uint32 { return hdr.uint32At(bfMagicOffset) }
+
+func (hdr *bfHeader) contentType() uint32 { return hdr.uint32At(bfContentTypeOffset) }
+
+func (hdr *bfHeader) setContentType(val uint32) { hdr.setUint32At(bfContentTypeOffset, val) }
+
+func (hdr *bfHeader) blocksize() uint32 { return hdr.uint32At(bfBlocksizeOffset) }
+
+func (hdr *bfHeader) nextFree() uint64 {
+	val := uint64(hdr.uint32At(bfNextFreeOffset))
+	if hdr.nextFreeHigh != 0 {
+		val |= uint64(hdr.uint32At(hdr.nextFreeHigh)) << 32
+	}
+	return val
+}
+
+func (hdr *bfHeader) setNextFree(val uint64) {
+	hdr.setUint32At(bfNextFreeOffset, uint32(val))
+	if hdr.nextFreeHigh != 0 {
+		hdr.setUint32At(hdr.nextFreeHigh, uint32(val>>32))
+	}
+}
+
+// bfFileHeader gives access to the header of the header block (index 0).
+type bfFileHeader struct {
+	bfHeader
+	v1Blocks uint64 // the number of blocks of a file of version 1, or 0 for later versions
+}
+
+func (hdr *bfFileHeader) highWater() uint64 {
+	if hdr.v1Blocks != 0 {
+		return hdr.v1Blocks
+	}
+	val := uint64(hdr.uint32At(bfHighWaterOffset))
+	if hdr.incompatFeatures()&IncompatLargeIndex != 0 {
+		val |= uint64(hdr.uint32At(bfHighWaterHighOffset)) << 32
+	}
+	return val
+}
+
+func (hdr *bfFileHeader) setHighWater(val uint64) {
+	if hdr.v1Blocks != 0 {
+		// the Mapper was already grown to the new high-water mark
+		return
+	}
+	hdr.setUint32At(bfHighWaterOffset, uint32(val))
+	if hdr.incompatFeatures()&IncompatLargeIndex != 0 {
+		hdr.setUint32At(bfHighWaterHighOffset, uint32(val>>32))
+	}
+}
+
+func (hdr *bfFileHeader) version() uint32 { return hdr.uint32At(bfVersionOffset) }
+
+func (hdr *bfFileHeader) compatFeatures() uint32 { return hdr.uint32At(bfCompatFeaturesOffset) }
+
+func (hdr *bfFileHeader) incompatFeatures() uint32 { return hdr.uint32At(bfIncompatFeaturesOffset) }
+
+// initFileHeader initializes the extended header of the header block.
+func (hdr *bfFileHeader) initFileHeader(highWater uint64, compat uint32, incompat uint32) {
+	hdr.setUint32At(bfMagicOffset, BlockFileMagic2)
+	hdr.setUint32At(bfVersionOffset, BlockFileVersion)
+	hdr.setUint32At(bfCompatFeaturesOffset, compat)
+	hdr.setUint32At(bfIncompatFeaturesOffset, incompat)
+	hdr.setHighWater(highWater)
+}
 
-func init() {
-	// ensure, the size of the bfHeader struct is correct
-	if reflect.TypeOf(bfHeader{}).Size() != uintptr(bfHeaderSize) {
-		panic("unexpected size for bfHeader struct")
+// byteOrderOf returns the byte order, in which the given magic number was
+// written, or nil if it isn't a magic number of a block-file.
+func byteOrderOf(magic []byte) binary.ByteOrder {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := order.Uint32(magic); m == BlockFileMagic || m == BlockFileMagic2 {
+			return order
+		}
 	}
+	return nil
 }
 
 func bfHeaderFromSlice(data []byte) (*bfHeader, error) {
 	if len(data) < bfHeaderSize {
 		return nil, fmt.Errorf("BlockFile: slice to small for bf header")
 	}
-	hdr := (*bfHeader)(unsafe.Pointer(&data[0]))
-	if hdr.magic == reversedBlockFileMagic {
-		return nil, fmt.Errorf("BlockFile: unable to read header: was the file generated on an other platform?")
-	} else if hdr.magic != BlockFileMagic {
+	order := byteOrderOf(data[bfMagicOffset:])
+	if order == nil {
 		return nil, fmt.Errorf("BlockFile: unable to read header: unexpected magic number")
 	}
-	return hdr, nil
+	return &bfHeader{data: data, order: order}, nil
 }
 
-func initBfHeaderFromSlice(data []byte, blocksize uint32) (*bfHeader, error) {
+func initBfHeaderFromSlice(data []byte, blocksize uint32, order binary.ByteOrder) (*bfHeader, error) {
 	if len(data) < bfHeaderSize {
 		return nil, fmt.Errorf("BlockFile: slice to small for bf header")
 	} else if len(data) < int(blocksize) {
 		return nil, fmt.Errorf("BlockFile: slice to small for storing the blocksize")
 	}
-	hdr := (*bfHeader)(unsafe.Pointer(&data[0]))
-	hdr.magic = BlockFileMagic
-	hdr.contentType = 0
-	hdr.blocksize = blocksize
-	hdr.nextFree = 0
+	hdr := &bfHeader{data: data, order: order}
+	hdr.setUint32At(bfMagicOffset, BlockFileMagic)
+	hdr.setContentType(0)
+	hdr.setUint32At(bfBlocksizeOffset, blocksize)
+	hdr.setNextFree(0)
 	return hdr, nil
 }
 
+// BlockFile is safe for concurrent use by multiple goroutines. Handlers that
+// are passed to MapBlock or MapHeader run while holding a read-lock, so the
+// mapping is never moved (by growing the Mapper in AllocateBlock) while a
+// handler runs. Because of this, the handlers must not call AllocateBlock,
+// FreeBlock, or Close of the same BlockFile (this would dead-lock).
+// Concurrent handlers, that write to the same block, must be synchronized by
+// the caller.
 type BlockFile struct {
+	mu        sync.RWMutex // write-locked while the Mapper or the header is modified
 	mapper    Mapper
 	blocksize uint32
+	order     binary.ByteOrder // the byte order of the headers
+	compat    uint32           // the compatible feature flags
+	incompat  uint32           // the incompatible feature flags
+	version   uint32           // the version of the format (1 or BlockFileVersion)
+	verify    bool             // verify the checksums in MapBlock and MapHeader
+	readOnly  bool
+	growth    GrowthPolicy
+
+	wal    Mapper     // the write-ahead log (see AttachWAL)
+	walSeq uint64     // the sequence number of the last transaction
+	txMu   sync.Mutex // held by the current (writable) transaction
+
+	shadowMu sync.Mutex     // protects readers
+	readers  map[uint64]int // the number of read-only Tx per transaction ID
+
+	snapMu     sync.RWMutex           // protects the snapshots and their copies of the blocks
+	snapshots  map[*Snapshot]struct{} // the open snapshots
+	snapSeq    uint64                 // the sequence number of the newest snapshot
+	heldBlocks []heldBlock            // the freed blocks, that are held back for the snapshots
+
+	bitmaps []int // the bitmap blocks (see WithBitmapAllocator)
+}
+
+// readOnlyMapper is implemented by Mappers that can be read-only (like
+// MappedFile).
+type readOnlyMapper interface {
+	ReadOnly() bool
+}
+
+// adviseMapper is implemented by Mappers that accept access-pattern hints
+// (like MappedFile).
+type adviseMapper interface {
+	Advise(off int64, length int, advice Advice) error
+}
+
+// lockMapper is implemented by Mappers that can lock memory in RAM (like
+// MappedFile).
+type lockMapper interface {
+	Lock(off int64, length int) error
+	Unlock(off int64, length int) error
+}
+
+// syncMapper is implemented by Mappers that can write ranges back to the
+// underlying storage (like MappedFile).
+type syncMapper interface {
+	SyncRange(off int64, length int, async bool) error
+}
+
+// size64Mapper is implemented by Mappers whose size may not fit into an int
+// (like WindowedMappedFile).
+type size64Mapper interface {
+	Size64() int64
+}
+
+func mapperSize(mapper Mapper) int64 {
+	if m, ok := mapper.(size64Mapper); ok {
+		return m.Size64()
+	}
+	return int64(mapper.Size())
+}
+
+func isReadOnlyMapper(mapper Mapper) bool {
+	ro, ok := mapper.(readOnlyMapper)
+	return ok && ro.ReadOnly()
 }
 
 // OpenBlockFile opens an existing block-file that is given as filename.
+// A committed transaction in the write-ahead log of the block-file (see
+// WithWAL) is replayed.
 func OpenBlockFile(filename string) (*BlockFile, error) {
 	mf, err := OpenMappedFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return OpenBlockFileFromMapper(mf)
+	return openBlockFileFromFile(filename, mf, defaultOptions())
+}
+
+// OpenBlockFileWithOptions opens an existing block-file that is given as
+// filename. The options are passed to OpenMappedFileWithOptions (for example
+// Preallocate, so that AllocateBlock reports a full disk as an error, or
+// WithFileLock, so that other processes, that use WithFileLock too, can't
+// allocate or free blocks while the block-file is open for writing). A
+// committed transaction in the write-ahead log of the block-file is replayed,
+// and with the WithWAL option, the log is attached.
+func OpenBlockFileWithOptions(filename string, opts ...Option) (*BlockFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	mf, err := OpenMappedFileWithOptions(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return openBlockFileFromFile(filename, mf, o)
+}
+
+// openBlockFileFromFile opens the block-file in the given MappedFile, and
+// recovers its write-ahead log. The MappedFile is closed on errors.
+func openBlockFileFromFile(filename string, mf *MappedFile, o options) (*BlockFile, error) {
+	bf, err := OpenBlockFileFromMapper(mf)
+	if err != nil {
+		mf.Close()
+		return nil, err
+	}
+	if err := bf.recoverWAL(filename, &o); err != nil {
+		bf.Close()
+		return nil, err
+	}
+	return bf, nil
+}
+
+// OpenBlockFileReadOnly opens an existing block-file that is given as filename
+// in read-only mode (see OpenMappedFileReadOnly). AllocateBlock and FreeBlock
+// return ErrReadOnly, and the handlers passed to MapBlock and MapHeader must
+// not write to the slice. It returns ErrRecoveryRequired, when the
+// write-ahead log of the block-file contains a committed transaction.
+func OpenBlockFileReadOnly(filename string) (*BlockFile, error) {
+	mf, err := OpenMappedFileReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	return openBlockFileFromFile(filename, mf, defaultOptions())
+}
+
+// OpenBlockFileCopyOnWrite opens an existing block-file that is given as
+// filename as a private copy-on-write mapping (see OpenMappedFileCopyOnWrite).
+// All changes, including allocated and freed blocks, are only made in memory
+// and are discarded on Close. A committed transaction in the write-ahead log
+// of the block-file is replayed to the private mapping only.
+func OpenBlockFileCopyOnWrite(filename string) (*BlockFile, error) {
+	mf, err := OpenMappedFileCopyOnWrite(filename)
+	if err != nil {
+		return nil, err
+	}
+	o := defaultOptions()
+	o.private = true
+	return openBlockFileFromFile(filename, mf, o)
 }
 
 // OpenBlockFileFromMapper opens an existing block-file by providig a Mapper.
+// Files of version 1 are opened as they are (see Version), so they stay
+// readable by older versions of this package. It returns an
+// *UnsupportedFeaturesError, when the file uses incompatible features, that
+// are not supported by this package.
 func OpenBlockFileFromMapper(mapper Mapper) (*BlockFile, error) {
 	var blocksize uint32
+	var order binary.ByteOrder
+	version := uint32(BlockFileVersion)
 	err := mapper.Map(0, bfHeaderSize, func(data []byte) error {
 		hdr, err := bfHeaderFromSlice(data)
 		if err != nil {
 			return err
 		}
-		blocksize = hdr.blocksize
+		if hdr.magic() != BlockFileMagic2 {
+			version = 1
+		}
+		blocksize = hdr.blocksize()
+		order = hdr.order
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	if mapper.Size() < int(blocksize) {
+	bf := &BlockFile{mapper: mapper, blocksize: blocksize, order: order, version: version, readOnly: isReadOnlyMapper(mapper)}
+	if version == 1 {
+		if blocksize < uint32(bfHeaderSize) || mapperSize(mapper) < int64(blocksize) {
+			return nil, fmt.Errorf("mapper is to small for the blocksize specified in the file")
+		}
+		return bf, nil
+	}
+	err = mapper.Map(0, bfFileHeaderSize, func(data []byte) error {
+		hdr := &bfFileHeader{bfHeader: bfHeader{data: data, order: order}}
+		if err := checkFileHeader(hdr); err != nil {
+			return err
+		}
+		bf.compat = hdr.compatFeatures()
+		bf.incompat = hdr.incompatFeatures()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if blocksize < uint32(bf.fileHeaderSize()+bf.checksumSize()) {
+		return nil, fmt.Errorf("BlockFile: the blocksize specified in the file is too small")
+	}
+	if mapperSize(mapper) < int64(blocksize) {
 		return nil, fmt.Errorf("mapper is to small for the blocksize specified in the file")
 	}
-	return &BlockFile{mapper: mapper, blocksize: blocksize}, nil
+	var highWater uint64
+	err = bf.mapFileHeader(bf, func(hdr *bfFileHeader) error {
+		highWater = hdr.highWater()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if highWater == 0 || highWater > uint64(bf.maxBlocks()) || mapperSize(mapper) < int64(highWater)*int64(blocksize) {
+		return nil, fmt.Errorf("BlockFile: mapper is to small for the blocks specified in the file")
+	}
+	if bf.hasBitmap() {
+		if err := bf.loadBitmaps(bf); err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
 }
 
 // CreateBlockFile creates a new block-file at the given filename with the DefaultBlocksize.
@@ -106,6 +456,7 @@ func CreateBlockFile(filename string) (*BlockFile, error) {
 }
 
 // CreateBlockFileWithSize creates a new block-file at the given filename with the given blocksize.
+// A file with the WALSuffix is left untouched (see CreateBlockFileWithOptions).
 func CreateBlockFileWithSize(filename string, blocksize uint32) (*BlockFile, error) {
 	mf, err := CreateMappedFile(filename, int64(blocksize))
 	if err != nil {
@@ -114,6 +465,51 @@ func CreateBlockFileWithSize(filename string, blocksize uint32) (*BlockFile, err
 	return CreateBlockFileInMapperWithSize(mf, blocksize)
 }
 
+// CreateBlockFileWithOptions creates a new block-file at the given filename
+// with the given blocksize. The options are passed to
+// OpenMappedFileWithOptions after the options that create (or replace) the
+// file with the size of a single block. With the WithWAL option, the
+// write-ahead log of a replaced block-file is reset. Without it, the file with
+// the WALSuffix is left untouched, so the log of a replaced block-file has to
+// be removed by the caller, otherwise it is replayed by OpenBlockFile. It
+// returns ErrNotWAL, when the file with the WALSuffix isn't a write-ahead log.
+func CreateBlockFileWithOptions(filename string, blocksize uint32, opts ...Option) (*BlockFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var log *MappedFile
+	if o.wal {
+		var err error
+		if log, err = createWAL(filename); err != nil {
+			return nil, err
+		}
+	}
+	opts = append([]Option{CreateIfMissing(), TruncateExisting(), WithSize(int64(blocksize))}, opts...)
+	mf, err := OpenMappedFileWithOptions(filename, opts...)
+	if err != nil {
+		if log != nil {
+			log.Close()
+		}
+		return nil, err
+	}
+	bf, err := CreateBlockFileInMapperWithOptions(mf, blocksize, opts...)
+	if err != nil {
+		if log != nil {
+			log.Close()
+		}
+		mf.Close()
+		return nil, err
+	}
+	if log != nil {
+		if err := bf.attachWALFile(log); err != nil {
+			bf.Close()
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
 // CreateBlockFileInMapper creates a new block-file in the given Mapper with the DefaultBlocksize.
 func CreateBlockFileInMapper(mapper Mapper) (*BlockFile, error) {
 	return CreateBlockFileInMapperWithSize(mapper, DefaultBlocksize)
@@ -121,8 +517,31 @@ func CreateBlockFileInMapper(mapper Mapper) (*BlockFile, error) {
 
 // CreateBlockFileInMapperWithSize creates a new block-file in the given Mapper with the given blocksize.
 func CreateBlockFileInMapperWithSize(mapper Mapper, blocksize uint32) (*BlockFile, error) {
-	bf := &BlockFile{mapper: mapper, blocksize: blocksize}
-	err := bf.initHeaderBlock(0, nil)
+	return CreateBlockFileInMapperWithOptions(mapper, blocksize)
+}
+
+// CreateBlockFileInMapperWithOptions creates a new block-file in the given
+// Mapper with the given blocksize. Only the options, that select the format
+// of the block-file (like LargeBlockIndices), have an effect.
+func CreateBlockFileInMapperWithOptions(mapper Mapper, blocksize uint32, opts ...Option) (*BlockFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if isReadOnlyMapper(mapper) {
+		return nil, ErrReadOnly
+	}
+	bf := &BlockFile{mapper: mapper, blocksize: blocksize, order: binary.LittleEndian, version: BlockFileVersion, incompat: o.incompatFeatures}
+	if minSize := bf.fileHeaderSize() + bf.checksumSize(); blocksize < uint32(minSize) {
+		return nil, fmt.Errorf("BlockFile: blocksize must be at least %d", minSize)
+	}
+	err := bf.initHeaderBlock(bf, 0, func(hdr *bfHeader) error {
+		(&bfFileHeader{bfHeader: *hdr}).initFileHeader(1, bf.compat, bf.incompat)
+		if bf.incompat&IncompatShadowPaging != 0 {
+			bf.writeMeta(hdr.data, 0, shadowMeta{next: 1, highWater: 1})
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -130,8 +549,19 @@ func CreateBlockFileInMapperWithSize(mapper Mapper, blocksize uint32) (*BlockFil
 	return bf, nil
 }
 
-// Close closes the underlying Mapper if it is a Closer
+// Close closes the underlying Mapper if it is a Closer. The open snapshots
+// are closed, and the blocks, that were held back for them, are freed.
 func (bf *BlockFile) Close() error {
+	if blocks := bf.closeSnapshots(); len(blocks) > 0 {
+		if _, err := bf.freeBlocksNow(blocks); err != nil {
+			return err
+		}
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if err := bf.closeWAL(); err != nil {
+		return err
+	}
 	if bf.mapper != nil {
 		closable, ok := bf.mapper.(io.Closer)
 		bf.mapper = nil
@@ -151,34 +581,303 @@ func (bf *BlockFile) BlockSize() int {
 	return int(bf.blocksize)
 }
 
+// ByteOrder returns the byte order, in which the headers of the block-file
+// are stored. New block-files use little endian. It can be used to store the
+// content of the blocks in the same byte order.
+func (bf *BlockFile) ByteOrder() binary.ByteOrder {
+	return bf.order
+}
+
+// Version returns the version of the format of the block-file. Files of
+// version 1 can be migrated to BlockFileVersion by UpgradeBlockFile.
+func (bf *BlockFile) Version() int {
+	return int(bf.version)
+}
+
+// Features returns the compatible and the incompatible feature flags of the
+// block-file (like IncompatLargeIndex).
+func (bf *BlockFile) Features() (compat uint32, incompat uint32) {
+	return bf.compat, bf.incompat
+}
+
+// fileHeaderSize returns the size of the header of the header block, which
+// is followed by the data section (see MapHeader).
+func (bf *BlockFile) fileHeaderSize() int {
+	if bf.version == 1 {
+		return bfHeaderSize
+	}
+	size := bfFileHeaderSize
+	if bf.incompat&IncompatLargeIndex != 0 {
+		size = bfLargeFileHeaderSize
+	}
+	if bf.incompat&IncompatShadowPaging != 0 {
+		size += 2 * bfMetaSize
+	}
+	return size
+}
+
+// maxBlocks returns the maximum number of blocks, that fit into the format of
+// the block-file, an int and the offsets of the Mapper.
+func (bf *BlockFile) maxBlocks() int64 {
+	max := int64(math.MaxInt64) / int64(bf.blocksize)
+	if bf.incompat&IncompatLargeIndex == 0 && max > math.MaxUint32 {
+		max = math.MaxUint32
+	}
+	if maxInt := int64(^uint(0) >> 1); max > maxInt {
+		max = maxInt
+	}
+	return max
+}
+
+// blockOffset returns the offset of the given block in the Mapper.
+func (bf *BlockFile) blockOffset(block int) (int64, error) {
+	if block < 0 {
+		return 0, fmt.Errorf("invalid block index %d", block)
+	}
+	if int64(block) >= bf.maxBlocks() {
+		return 0, ErrBlockIndexOverflow
+	}
+	return int64(block) * int64(bf.blocksize), nil
+}
+
+// blockIndex converts a block-index from a header into an int.
+func (bf *BlockFile) blockIndex(val uint64) (int, error) {
+	if val >= uint64(bf.maxBlocks()) {
+		return 0, ErrBlockIndexOverflow
+	}
+	return int(val), nil
+}
+
+// SetGrowthPolicy sets the policy, that decides how many blocks are added,
+// when the Mapper needs to grow (see GrowthPolicy). The default is GrowExact.
+func (bf *BlockFile) SetGrowthPolicy(policy GrowthPolicy) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.growth = policy
+}
+
+// NumBlocks returns the number of blocks that were handed out so far
+// (including the header block and the blocks in the free-list). This is the
+// high-water mark of the block-file, which can be lower than the number of
+// blocks that fit into the Mapper.
+func (bf *BlockFile) NumBlocks() (int, error) {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	var highWater uint64
+	err := bf.mapFileHeader(bf, func(hdr *bfFileHeader) error {
+		highWater = hdr.highWater()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if highWater > uint64(bf.maxBlocks()) {
+		return 0, ErrBlockIndexOverflow
+	}
+	return int(highWater), nil
+}
+
+// ReadOnly returns true, if the block-file was opened in read-only mode.
+func (bf *BlockFile) ReadOnly() bool {
+	return bf.readOnly
+}
+
 // MapBlock maps the block with the given index, and calls the handler.
 // MapBlock is basically a wrapper for Mapper.Map that works with block-indices.
+// With IncompatChecksums, the checksum at the end of the block is not passed
+// to the handler, and it is verified before, when enabled by
+// SetVerifyChecksums.
 func (bf *BlockFile) MapBlock(block int, handler func([]byte) error) error {
+	if bf.hasShadowPaging() {
+		return ErrShadowPaging
+	}
+	return bf.mapBlock(block, true, true, handler)
+}
+
+// mapBlock maps the given block without its checksum. With write, the block
+// is copied for the open snapshots before (see Snapshot).
+func (bf *BlockFile) mapBlock(block int, verify bool, write bool, handler func([]byte) error) error {
 	if block <= 0 {
 		return fmt.Errorf("can't map block 0. This is the header-block.")
 	}
-	return bf.mapper.Map(int64(block)*int64(bf.blocksize), int(bf.blocksize), handler)
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.mapper.Map(off, int(bf.blocksize), func(data []byte) error {
+		if verify && bf.verify {
+			if err := bf.verifyChecksum(block, data); err != nil {
+				return err
+			}
+		}
+		if write {
+			bf.preserve(block, data)
+		}
+		return handler(data[:len(data)-bf.checksumSize()])
+	})
+}
+
+// AdviseBlocks tells the operating system how the given number of blocks,
+// starting with the given block-index, will be accessed (see
+// MappedFile.Advise). It returns ErrNotSupported, when the Mapper does not
+// support advices.
+func (bf *BlockFile) AdviseBlocks(block int, count int, advice Advice) error {
+	if block < 0 || count < 0 {
+		return fmt.Errorf("invalid block range %d+%d", block, count)
+	}
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	adviser, ok := bf.mapper.(adviseMapper)
+	if !ok {
+		return ErrNotSupported
+	}
+	if int64(count) > bf.maxBlocks()-int64(block) {
+		return ErrBlockIndexOverflow
+	}
+	length := int64(count) * int64(bf.blocksize)
+	if length != int64(int(length)) {
+		return fmt.Errorf("block range %d+%d is too large", block, count)
+	}
+	return adviser.Advise(off, int(length), advice)
+}
+
+// SyncBlock writes the changes of the given block back to the file, and waits
+// until they are written (see MappedFile.SyncRange). Block-index 0 is the
+// header block.
+// It returns ErrNotSupported, when the Mapper does not support syncing ranges.
+func (bf *BlockFile) SyncBlock(block int) error {
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	syncer, ok := bf.mapper.(syncMapper)
+	if !ok {
+		return ErrNotSupported
+	}
+	return syncer.SyncRange(off, int(bf.blocksize), false)
+}
+
+// PinHeader locks the header block in RAM (see MappedFile.Lock).
+// It returns ErrNotSupported, when the Mapper does not support locking.
+func (bf *BlockFile) PinHeader() error {
+	return bf.PinBlocks(0)
 }
 
-func (bf *BlockFile) initHeaderBlock(block int, handler func(*bfHeader) error) error {
-	return bf.mapper.Map(int64(block)*int64(bf.blocksize), int(bf.blocksize), func(data []byte) error {
-		hdr, err := initBfHeaderFromSlice(data, bf.blocksize)
+// PinBlocks locks the given blocks in RAM (see MappedFile.Lock). Block-index 0
+// is the header block. The blocks are unpinned by UnpinBlocks, and when the
+// Mapper is truncated (for example by AllocateBlock) or closed.
+// It returns ErrNotSupported, when the Mapper does not support locking.
+func (bf *BlockFile) PinBlocks(blocks ...int) error {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	locker, ok := bf.mapper.(lockMapper)
+	if !ok {
+		return ErrNotSupported
+	}
+	for _, block := range blocks {
+		off, err := bf.blockOffset(block)
 		if err != nil {
 			return err
 		}
+		if err := locker.Lock(off, int(bf.blocksize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpinBlocks unlocks the given blocks, that were locked by PinBlocks or
+// PinHeader.
+// It returns ErrNotSupported, when the Mapper does not support locking.
+func (bf *BlockFile) UnpinBlocks(blocks ...int) error {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	locker, ok := bf.mapper.(lockMapper)
+	if !ok {
+		return ErrNotSupported
+	}
+	for _, block := range blocks {
+		off, err := bf.blockOffset(block)
+		if err != nil {
+			return err
+		}
+		if err := locker.Unlock(off, int(bf.blocksize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawBlockMapper maps whole blocks, including their headers and checksums.
+// It is implemented by BlockFile itself, and by WALTx, which buffers the
+// changes until they are committed. The free-list is managed through it.
+type rawBlockMapper interface {
+	mapRawBlock(block int, handler func([]byte) error) error
+	// readRawBlock is like mapRawBlock, but the handler must not change the
+	// block.
+	readRawBlock(block int, handler func([]byte) error) error
+}
+
+func (bf *BlockFile) mapRawBlock(block int, handler func([]byte) error) error {
+	return bf.mapRawBlockUnpreserved(block, func(data []byte) error {
+		bf.preserve(block, data)
+		return handler(data)
+	})
+}
+
+func (bf *BlockFile) readRawBlock(block int, handler func([]byte) error) error {
+	return bf.mapRawBlockUnpreserved(block, handler)
+}
+
+// mapRawBlockUnpreserved is like mapRawBlock, but it doesn't copy the block
+// for the open snapshots, so the handler must not change it.
+func (bf *BlockFile) mapRawBlockUnpreserved(block int, handler func([]byte) error) error {
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	return bf.mapper.Map(off, int(bf.blocksize), handler)
+}
+
+func (bf *BlockFile) initHeaderBlock(raw rawBlockMapper, block int, handler func(*bfHeader) error) error {
+	return raw.mapRawBlock(block, func(data []byte) error {
+		hdr, err := initBfHeaderFromSlice(data, bf.blocksize, bf.order)
+		if err != nil {
+			return err
+		}
+		hdr.nextFreeHigh = bf.nextFreeHighOffset(block)
+		hdr.setNextFree(0)
 		if handler != nil {
-			return handler(hdr)
+			if err := handler(hdr); err != nil {
+				return err
+			}
 		}
+		bf.setChecksum(data)
 		return nil
 	})
 }
 
-func (bf *BlockFile) mapHeaderBlock(block int, handler func(*bfHeader) error) error {
-	return bf.mapper.Map(int64(block)*int64(bf.blocksize), int(bf.blocksize), func(data []byte) error {
+// mapHeaderBlock maps the header of the given block for reading, so the
+// handler must not change it (see updateHeaderBlock).
+func (bf *BlockFile) mapHeaderBlock(raw rawBlockMapper, block int, handler func(*bfHeader) error) error {
+	return bf.mapHeaderBlockWith(raw.readRawBlock, block, handler)
+}
+
+func (bf *BlockFile) mapHeaderBlockWith(mapRaw func(int, func([]byte) error) error, block int, handler func(*bfHeader) error) error {
+	return mapRaw(block, func(data []byte) error {
 		hdr, err := bfHeaderFromSlice(data)
 		if err != nil {
 			return err
 		}
+		hdr.nextFreeHigh = bf.nextFreeHighOffset(block)
 		if handler != nil {
 			return handler(hdr)
 		}
@@ -186,17 +885,75 @@ func (bf *BlockFile) mapHeaderBlock(block int, handler func(*bfHeader) error) er
 	})
 }
 
+// nextFreeHighOffset returns the offset of the upper 32 bits of nextFree in
+// the header of the given block, or 0 without IncompatLargeIndex.
+func (bf *BlockFile) nextFreeHighOffset(block int) int {
+	if bf.incompat&IncompatLargeIndex == 0 {
+		return 0
+	} else if block == 0 {
+		return bfNextFreeHighOffset
+	}
+	return bfBlockNextFreeHighOffset
+}
+
+// updateHeaderBlock is like mapHeaderBlock, but it seals the block after the
+// handler changed the header.
+func (bf *BlockFile) updateHeaderBlock(raw rawBlockMapper, block int, handler func(*bfHeader) error) error {
+	return bf.mapHeaderBlockWith(raw.mapRawBlock, block, func(hdr *bfHeader) error {
+		if err := handler(hdr); err != nil {
+			return err
+		}
+		bf.setChecksum(hdr.data)
+		return nil
+	})
+}
+
+func (bf *BlockFile) mapFileHeader(raw rawBlockMapper, handler func(*bfFileHeader) error) error {
+	return bf.mapHeaderBlock(raw, 0, func(hdr *bfHeader) error {
+		return handler(bf.fileHeader(hdr))
+	})
+}
+
+func (bf *BlockFile) updateFileHeader(raw rawBlockMapper, handler func(*bfFileHeader) error) error {
+	return bf.updateHeaderBlock(raw, 0, func(hdr *bfHeader) error {
+		return handler(bf.fileHeader(hdr))
+	})
+}
+
+// fileHeader returns the header of the header block. For files of version 1,
+// the high-water mark is the number of blocks in the Mapper.
+func (bf *BlockFile) fileHeader(hdr *bfHeader) *bfFileHeader {
+	fh := &bfFileHeader{bfHeader: *hdr}
+	if bf.version == 1 {
+		fh.v1Blocks = uint64((mapperSize(bf.mapper) + int64(bf.blocksize) - 1) / int64(bf.blocksize))
+	}
+	return fh
+}
+
 // MapHeader maps the data section of header block (index 0), and calls the handler.
-// The returned slice is a little bit smaller than the blocksize.
+// The returned slice is a little bit smaller than the blocksize: 16 bytes in
+// files of version 1, and 32 bytes since version 2 (40 bytes with
+// IncompatLargeIndex, and 128 bytes more with IncompatShadowPaging). So
+// UpgradeBlockFile moves the data section, and it becomes 16 bytes smaller. With
+// IncompatChecksums, the checksum of the header block is verified before,
+// when enabled by SetVerifyChecksums, and changes must be sealed by
+// SealHeader.
 func (bf *BlockFile) MapHeader(handler func(data []byte, contentType uint32) error) error {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
 	return bf.mapper.Map(0, int(bf.blocksize), func(data []byte) error {
 		hdr, err := bfHeaderFromSlice(data)
 		if err != nil {
 			return err
 		}
-		contentType := hdr.contentType
+		if bf.verify {
+			if err := bf.verifyChecksum(0, data); err != nil {
+				return err
+			}
+		}
+		contentType := hdr.contentType()
 		if handler != nil {
-			return handler(data[bfHeaderSize:], contentType)
+			return handler(data[bf.fileHeaderSize():len(data)-bf.checksumSize()], contentType)
 		}
 		return nil
 	})
@@ -204,85 +961,188 @@ func (bf *BlockFile) MapHeader(handler func(data []byte, contentType uint32) err
 
 // AllocateBlock returns a new unused block-index. This either returns a block
 // from an internal free-list (a block that was Freed earlier by FreeBlock), or
-// allocates new space by calling Truncate on the mapper.
+// a block after the high-water mark of the blocks that were handed out so far.
+// When there is no space left for the new block, the Mapper grows by calling
+// Truncate according to the GrowthPolicy (see SetGrowthPolicy).
 func (bf *BlockFile) AllocateBlock() (int, error) {
-	var block int = 0
-	err := bf.mapHeaderBlock(0, func(hdr *bfHeader) error {
-		block = int(hdr.nextFree)
-		return nil
-	})
+	blocks, err := bf.AllocateBlocks(1)
 	if err != nil {
 		return 0, err
 	}
-	if block != 0 {
-		// get the next free block
-		var nextFree uint32 = 0
-		err := bf.mapHeaderBlock(block, func(hdr *bfHeader) error {
-			if hdr.contentType != ContentFreeList {
-				return fmt.Errorf("block %d is not marked as free", block)
-			}
-			nextFree = hdr.nextFree
-			return nil
-		})
+	return blocks[0], nil
+}
+
+// AllocateBlocks allocates a given number ob blocks (see AllocateBlock).
+// Blocks from the free-list are used first. For the remaining blocks, the
+// Mapper grows at most once.
+func (bf *BlockFile) AllocateBlocks(num int) ([]int, error) {
+	if bf.readOnly {
+		return nil, ErrReadOnly
+	}
+	if bf.hasShadowPaging() {
+		return nil, ErrShadowPaging
+	}
+	if bf.hasWAL() {
+		return bf.allocateBlocksLogged(num)
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.allocateBlocks(bf, num)
+}
+
+func (bf *BlockFile) allocateBlocks(raw rawBlockMapper, num int) ([]int, error) {
+	if bf.hasBitmap() {
+		return bf.allocateBitmapBlocks(raw, num)
+	}
+	blocks := make([]int, 0, num)
+	for len(blocks) < num {
+		block, err := bf.popFreeBlock(raw)
 		if err != nil {
-			return 0, err
+			return blocks, err
+		}
+		if block == 0 {
+			break
 		}
-		// update nextFree in the header
-		err = bf.mapHeaderBlock(0, func(hdr *bfHeader) error {
-			hdr.nextFree = nextFree
-			return nil
-		})
+		blocks = append(blocks, block)
+	}
+	if n := num - len(blocks); n > 0 {
+		first, err := bf.allocateNewBlocks(raw, n)
 		if err != nil {
-			return 0, err
+			return blocks, err
+		}
+		for i := 0; i < n; i++ {
+			blocks = append(blocks, first+i)
 		}
-		return block, nil
 	}
-	// allocate new block
-	newBlockIndex := (int64(bf.mapper.Size()) + int64(bf.blocksize) - 1) / int64(bf.blocksize)
-	err = bf.mapper.Truncate((newBlockIndex + 1) * int64(bf.blocksize))
+	return blocks, nil
+}
+
+// popFreeBlock removes the first block from the free-list and returns it.
+// It returns 0, when the free-list is empty.
+func (bf *BlockFile) popFreeBlock(raw rawBlockMapper) (int, error) {
+	var block int = 0
+	err := bf.mapHeaderBlock(raw, 0, func(hdr *bfHeader) (err error) {
+		block, err = bf.blockIndex(hdr.nextFree())
+		return err
+	})
+	if err != nil || block == 0 {
+		return 0, err
+	}
+	// get the next free block
+	var nextFree uint64 = 0
+	err = bf.mapHeaderBlock(raw, block, func(hdr *bfHeader) error {
+		if hdr.contentType() != ContentFreeList {
+			return fmt.Errorf("block %d is not marked as free", block)
+		}
+		nextFree = hdr.nextFree()
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
-	return int(newBlockIndex), nil
+	// update nextFree in the header
+	err = bf.updateHeaderBlock(raw, 0, func(hdr *bfHeader) error {
+		hdr.setNextFree(nextFree)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return block, nil
 }
 
-// AllocateBlocks allocates a given number ob blocks (see AllocateBlock)
-func (bf *BlockFile) AllocateBlocks(num int) ([]int, error) {
-	blocks := make([]int, num)
-	for n := 0; n < num; n++ {
-		block, err := bf.AllocateBlock()
-		if err != nil {
-			return blocks[0:n], err
-		}
-		blocks[n] = block
+// allocateNewBlocks hands out the given number of blocks after the high-water
+// mark, and returns the index of the first block.
+func (bf *BlockFile) allocateNewBlocks(raw rawBlockMapper, n int) (int, error) {
+	var highWater int64
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) error {
+		val, err := bf.blockIndex(hdr.highWater())
+		highWater = int64(val)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	return blocks, nil
+	maxBlocks := bf.maxBlocks()
+	if int64(n) > maxBlocks-highWater {
+		return 0, ErrBlockIndexOverflow
+	}
+	required := highWater + int64(n)
+	if err := bf.growMapper(required); err != nil {
+		return 0, err
+	}
+	if err := bf.sealNewBlocks(raw, int(highWater), n); err != nil {
+		return 0, err
+	}
+	err = bf.updateFileHeader(raw, func(hdr *bfFileHeader) error {
+		hdr.setHighWater(uint64(required))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(highWater), nil
+}
+
+// growMapper grows the Mapper with the GrowthPolicy, when it holds less than
+// the required number of blocks.
+func (bf *BlockFile) growMapper(required int64) error {
+	blocks := mapperSize(bf.mapper) / int64(bf.blocksize)
+	if required <= blocks {
+		return nil
+	}
+	growth := bf.growth
+	if growth == nil || bf.version == 1 {
+		// the size of a file of version 1 is its high-water mark
+		growth = GrowExact()
+	}
+	newBlocks := growth(blocks, required)
+	if newBlocks < required {
+		newBlocks = required
+	} else if maxBlocks := bf.maxBlocks(); newBlocks > maxBlocks {
+		newBlocks = maxBlocks
+	}
+	return bf.mapper.Truncate(newBlocks * int64(bf.blocksize))
 }
 
 // FreeBlock puts the given block to an internal free-list, so that the block
 // can be returned by future call to AllocateBlock.
+// While snapshots are open, the block is held back from the free-list (see
+// Snapshot). Held blocks are only kept in memory, so they are lost (they stay
+// allocated), when the process ends without closing the BlockFile.
 func (bf *BlockFile) FreeBlock(block int) error {
+	_, err := bf.FreeBlocks([]int{block})
+	return err
+}
+
+func (bf *BlockFile) freeBlock(raw rawBlockMapper, block int) error {
+	if bf.hasBitmap() {
+		return bf.freeBitmapBlock(raw, block)
+	}
 	// get the old nextFree block
-	var nextFree uint32 = 0
-	err := bf.mapHeaderBlock(0, func(hdr *bfHeader) error {
-		nextFree = hdr.nextFree
+	var nextFree uint64 = 0
+	err := bf.mapFileHeader(raw, func(hdr *bfFileHeader) error {
+		if block <= 0 || uint64(block) >= hdr.highWater() {
+			return fmt.Errorf("block %d is not allocated", block)
+		}
+		nextFree = hdr.nextFree()
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 	// create a new free-list entry, in the free block
-	err = bf.initHeaderBlock(block, func(hdr *bfHeader) error {
-		hdr.contentType = ContentFreeList
-		hdr.nextFree = nextFree
+	err = bf.initHeaderBlock(raw, block, func(hdr *bfHeader) error {
+		hdr.setContentType(ContentFreeList)
+		hdr.setNextFree(nextFree)
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 	// update nextFree in the header
-	err = bf.mapHeaderBlock(0, func(hdr *bfHeader) error {
-		hdr.nextFree = uint32(block)
+	err = bf.updateHeaderBlock(raw, 0, func(hdr *bfHeader) error {
+		hdr.setNextFree(uint64(block))
 		return nil
 	})
 	if err != nil {
@@ -293,9 +1153,35 @@ func (bf *BlockFile) FreeBlock(block int) error {
 
 // FreeBlocks frees a given number ob blocks (see FreeBlock)
 func (bf *BlockFile) FreeBlocks(blocks []int) (int, error) {
+	if bf.readOnly {
+		return 0, ErrReadOnly
+	}
+	if bf.hasShadowPaging() {
+		return 0, ErrShadowPaging
+	}
+	if held, err := bf.holdBack(blocks); held || err != nil {
+		if err != nil {
+			return 0, err
+		}
+		return len(blocks), nil
+	}
+	return bf.freeBlocksNow(blocks)
+}
+
+// freeBlocksNow puts the given blocks to the free-list.
+func (bf *BlockFile) freeBlocksNow(blocks []int) (int, error) {
+	if bf.hasWAL() {
+		return bf.freeBlocksLogged(blocks)
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.freeBlocks(bf, blocks)
+}
+
+func (bf *BlockFile) freeBlocks(raw rawBlockMapper, blocks []int) (int, error) {
 	n := 0
 	for _, block := range blocks {
-		if err := bf.FreeBlock(block); err != nil {
+		if err := bf.freeBlock(raw, block); err != nil {
 			return n, err
 		}
 		n++
@@ -1,7 +1,13 @@
 package mmf_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
 	"os"
+	"runtime"
+	"sync"
 	"testing"
 
 	. "github.com/HellButcher/go-mmstruct/mmf"
@@ -112,3 +118,789 @@ func TestCreateAllocateANdFreeBF(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenBlockFileReadOnly(t *testing.T) {
+	defer os.Remove("bftest2.tmp")
+	{
+		bf, err := CreateBlockFileWithSize("bftest2.tmp", 32)
+		if err != nil {
+			t.Fatal("Error while creating block file:", err)
+		}
+		if _, err := bf.AllocateBlock(); err != nil {
+			t.Fatal("Error while allocatin block 1", err)
+		}
+		closeBF(bf, t)
+	}
+	bf, err := OpenBlockFileReadOnly("bftest2.tmp")
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	defer closeBF(bf, t)
+	if !bf.ReadOnly() {
+		t.Error("expected the block file to be read-only")
+	}
+	if bf.BlockSize() != 32 {
+		t.Error("unexpected block size. expected 32, got", bf.BlockSize())
+	}
+	if err := bf.MapBlock(1, func([]byte) error { return nil }); err != nil {
+		t.Error("Error while mapping block 1", err)
+	}
+	if _, err := bf.AllocateBlock(); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from AllocateBlock, got", err)
+	}
+	if err := bf.FreeBlock(1); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from FreeBlock, got", err)
+	}
+}
+
+func TestOpenBlockFileCopyOnWrite(t *testing.T) {
+	defer os.Remove("bftest3.tmp")
+	{
+		bf, err := CreateBlockFileWithSize("bftest3.tmp", 32)
+		if err != nil {
+			t.Fatal("Error while creating block file:", err)
+		}
+		closeBF(bf, t)
+	}
+	{
+		bf, err := OpenBlockFileCopyOnWrite("bftest3.tmp")
+		if err != nil {
+			t.Fatal("Error while opening block file:", err)
+		}
+		defer closeBF(bf, t)
+		for n := 1; n < 4; n++ {
+			block, err := bf.AllocateBlock()
+			if err != nil {
+				t.Fatal("Error while allocatin block", n, err)
+			}
+			if block != n {
+				t.Error("unexpected block index. expected ", n, ", got", block)
+			}
+		}
+		if err := bf.FreeBlock(2); err != nil {
+			t.Fatal("Error while freeing block 2", err)
+		}
+		closeBF(bf, t)
+	}
+	bf, err := OpenBlockFile("bftest3.tmp")
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	defer closeBF(bf, t)
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocatin block 1", err)
+	}
+	if block != 1 {
+		t.Error("unexpected block index. expected 1, got ", block)
+	}
+}
+
+func TestBlockFileInAnonymousMapping(t *testing.T) {
+	mf, err := NewAnonymousMapping(32)
+	if err != nil {
+		t.Fatal("Error while creating anonymous mapping:", err)
+	}
+	bf, err := CreateBlockFileInMapperWithSize(mf, 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	for n := 1; n < 10; n++ {
+		block, err := bf.AllocateBlock()
+		if err != nil {
+			t.Fatal("Error while allocatin block", n, err)
+		}
+		if block != n {
+			t.Error("unexpected block index. expected ", n, ", got", block)
+		}
+	}
+}
+
+func TestBlockFileInMemoryMapper(t *testing.T) {
+	mm := NewMemoryMapper(0)
+	if err := mm.Truncate(32); err != nil {
+		t.Fatal("Error while truncating memory:", err)
+	}
+	bf, err := CreateBlockFileInMapperWithSize(mm, 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	for n := 1; n < 10; n++ {
+		block, err := bf.AllocateBlock()
+		if err != nil {
+			t.Fatal("Error while allocatin block", n, err)
+		}
+		if block != n {
+			t.Error("unexpected block index. expected ", n, ", got", block)
+		}
+	}
+	if err := bf.FreeBlock(5); err != nil {
+		t.Fatal("Error while freeing block 5", err)
+	}
+
+	// reopen from a snapshot
+	var buf bytes.Buffer
+	if _, err := mm.WriteTo(&buf); err != nil {
+		t.Fatal("Error while writing snapshot:", err)
+	}
+	mm2 := NewMemoryMapper(0)
+	if _, err := mm2.ReadFrom(&buf); err != nil {
+		t.Fatal("Error while loading snapshot:", err)
+	}
+	bf2, err := OpenBlockFileFromMapper(mm2)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	block, err := bf2.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocatin block 5", err)
+	}
+	if block != 5 {
+		t.Error("unexpected block index. expected 5, got ", block)
+	}
+}
+
+func TestAdviseBlocks(t *testing.T) {
+	defer os.Remove("bftest5.tmp")
+	bf, err := CreateBlockFileWithSize("bftest5.tmp", 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	if _, err := bf.AllocateBlocks(10); err != nil {
+		t.Fatal("Error while allocating blocks", err)
+	}
+	if err := bf.AdviseBlocks(1, 10, AdviceWillNeed); err != nil {
+		t.Error("Error while advising blocks", err)
+	}
+
+	bf2, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(32), 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if err := bf2.AdviseBlocks(0, 1, AdviceWillNeed); err != ErrNotSupported {
+		t.Error("expected ErrNotSupported, got", err)
+	}
+}
+
+func TestPinBlocks(t *testing.T) {
+	defer os.Remove("bftest6.tmp")
+	bf, err := CreateBlockFileWithSize("bftest6.tmp", 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	if _, err := bf.AllocateBlocks(10); err != nil {
+		t.Fatal("Error while allocating blocks", err)
+	}
+	err = bf.PinHeader()
+	if _, ok := err.(*MemlockLimitError); ok {
+		t.Skip("locking memory is not permitted:", err)
+	}
+	if err != nil {
+		t.Fatal("Error while pinning header", err)
+	}
+	if err := bf.PinBlocks(3, 7); err != nil {
+		t.Error("Error while pinning blocks", err)
+	}
+	if err := bf.UnpinBlocks(0, 3, 7); err != nil {
+		t.Error("Error while unpinning blocks", err)
+	}
+}
+
+func TestSyncBlock(t *testing.T) {
+	defer os.Remove("bftest7.tmp")
+	bf, err := CreateBlockFileWithSize("bftest7.tmp", 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocatin block 1", err)
+	}
+	err = bf.MapBlock(block, func(data []byte) error {
+		copy(data, []byte("ABCDE"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block 1", err)
+	}
+	if err := bf.SyncBlock(block); err != nil {
+		t.Error("Error while syncing block 1", err)
+	}
+	if err := bf.SyncBlock(0); err != nil {
+		t.Error("Error while syncing header block", err)
+	}
+	if err := bf.SyncBlock(5); err == nil {
+		t.Error("expected an error when syncing a block out of bounds")
+	}
+}
+
+type truncateCountingMapper struct {
+	*MemoryMapper
+	truncates int
+}
+
+func (m *truncateCountingMapper) Truncate(size int64) error {
+	m.truncates++
+	return m.MemoryMapper.Truncate(size)
+}
+
+func TestGrowthPolicy(t *testing.T) {
+	mapper := &truncateCountingMapper{MemoryMapper: NewMemoryMapper(32)}
+	bf, err := CreateBlockFileInMapperWithSize(mapper, 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	blocks, err := bf.AllocateBlocks(10)
+	if err != nil {
+		t.Fatal("Error while allocating blocks", err)
+	}
+	if len(blocks) != 10 || blocks[0] != 1 || blocks[9] != 10 {
+		t.Error("unexpected blocks", blocks)
+	}
+	if mapper.truncates != 1 {
+		t.Error("expected a single Truncate, got", mapper.truncates)
+	}
+	if mapper.Size() != 11*32 {
+		t.Error("unexpected size", mapper.Size())
+	}
+
+	bf.SetGrowthPolicy(GrowByDoubling())
+	if _, err := bf.AllocateBlock(); err != nil {
+		t.Fatal("Error while allocating block", err)
+	}
+	if mapper.Size() != 22*32 {
+		t.Error("unexpected size after doubling", mapper.Size())
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := bf.AllocateBlock(); err != nil {
+			t.Fatal("Error while allocating block", err)
+		}
+	}
+	if mapper.truncates != 2 {
+		t.Error("expected no Truncate while blocks are left, got", mapper.truncates)
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 22 {
+		t.Error("unexpected number of blocks", n, err)
+	}
+
+	// the high-water mark is persisted in the header
+	bf2, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	block, err := bf2.AllocateBlock()
+	if err != nil || block != 22 {
+		t.Error("unexpected block", block, err)
+	}
+	if err := bf2.FreeBlock(30); err == nil {
+		t.Error("expected an error when freeing an unallocated block")
+	}
+}
+
+func TestGrowthPolicies(t *testing.T) {
+	if n := GrowExact()(4, 7); n != 7 {
+		t.Error("GrowExact: unexpected", n)
+	}
+	if n := GrowByChunk(8)(4, 9); n != 16 {
+		t.Error("GrowByChunk: unexpected", n)
+	}
+	if n := GrowByDoubling()(4, 9); n != 16 {
+		t.Error("GrowByDoubling: unexpected", n)
+	}
+	if n := GrowByCappedDoubling(5)(4, 9); n != 13 {
+		t.Error("GrowByCappedDoubling: unexpected", n)
+	}
+	if n := GrowByCappedDoubling(5)(2, 3); n != 4 {
+		t.Error("GrowByCappedDoubling: unexpected", n)
+	}
+}
+
+func TestBlockFileWithFileLock(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		t.Skip("file locks are owned by the process on", runtime.GOOS)
+	}
+	defer os.Remove("bftest9.tmp")
+	bf, err := CreateBlockFileWithOptions("bftest9.tmp", 32, WithFileLock())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := OpenBlockFileWithOptions("bftest9.tmp", ReadOnly(), WithFileLockNoWait()); err != ErrFileLocked {
+		t.Error("expected ErrFileLocked, got", err)
+	}
+	closeBF(bf, t)
+
+	bf1, err := OpenBlockFileWithOptions("bftest9.tmp", ReadOnly(), WithFileLockNoWait())
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	defer closeBF(bf1, t)
+	bf2, err := OpenBlockFileWithOptions("bftest9.tmp", ReadOnly(), WithFileLockNoWait())
+	if err != nil {
+		t.Fatal("Error while opening block file for a second reader:", err)
+	}
+	defer closeBF(bf2, t)
+	if _, err := OpenBlockFileWithOptions("bftest9.tmp", WithFileLockNoWait()); err != ErrFileLocked {
+		t.Error("expected ErrFileLocked for a writer, got", err)
+	}
+}
+
+func TestBlockFileConcurrent(t *testing.T) {
+	defer os.Remove("bftest10.tmp")
+	bf, err := CreateBlockFileWithSize("bftest10.tmp", 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	bf2, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	for _, bf := range []*BlockFile{bf, bf2} {
+		const workers, perWorker = 8, 50
+		var wg sync.WaitGroup
+		results := make([][]int, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWorker; i++ {
+					block, err := bf.AllocateBlock()
+					if err != nil {
+						t.Error("Error while allocating block", err)
+						return
+					}
+					err = bf.MapBlock(block, func(data []byte) error {
+						binary.LittleEndian.PutUint64(data, uint64(block))
+						return nil
+					})
+					if err != nil {
+						t.Error("Error while mapping block", err)
+						return
+					}
+					if i%5 == 4 {
+						if err := bf.FreeBlock(block); err != nil {
+							t.Error("Error while freeing block", err)
+						}
+						continue
+					}
+					results[w] = append(results[w], block)
+				}
+			}(w)
+		}
+		wg.Wait()
+		seen := make(map[int]bool)
+		for _, blocks := range results {
+			for _, block := range blocks {
+				if seen[block] {
+					t.Fatal("block was allocated twice:", block)
+				}
+				seen[block] = true
+				err := bf.MapBlock(block, func(data []byte) error {
+					if v := binary.LittleEndian.Uint64(data); v != uint64(block) {
+						t.Errorf("unexpected content of block %d: %d", block, v)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error("Error while mapping block", err)
+				}
+			}
+		}
+	}
+}
+
+func TestBlockFileAtomic(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block", err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := bf.AddUint64(block, 8, 1); err != nil {
+					t.Error("Error while adding:", err)
+					return
+				}
+				// grow the mapper concurrently
+				if _, err := bf.AllocateBlock(); err != nil {
+					t.Error("Error while allocating block", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := bf.LoadUint64(block, 8); err != nil || v != 800 {
+		t.Error("unexpected value", v, err)
+	}
+	if ok, err := bf.CompareAndSwapUint32(block, 4, 0, 7); !ok || err != nil {
+		t.Error("expected CompareAndSwap to succeed, got", ok, err)
+	}
+	if _, err := bf.LoadUint32(block, 2); err != ErrUnaligned {
+		t.Error("expected ErrUnaligned, got", err)
+	}
+	if _, err := bf.LoadUint64(block, 60); err == nil {
+		t.Error("expected an error for an offset out of the block")
+	}
+	if err := bf.StoreUint32(0, 0, 1); err == nil {
+		t.Error("expected an error for the header block")
+	}
+}
+
+func TestBlockFileByteOrder(t *testing.T) {
+	// a block-file with 3 blocks, that was created on a big endian platform
+	be := binary.BigEndian
+	data := make([]byte, 3*32)
+	be.PutUint32(data[0:], BlockFileMagic2)
+	be.PutUint32(data[8:], 32)                // blocksize
+	be.PutUint32(data[12:], 2)                // nextFree
+	be.PutUint32(data[16:], 3)                // highWater
+	be.PutUint32(data[20:], BlockFileVersion) // version
+	be.PutUint32(data[64:], BlockFileMagic)
+	be.PutUint32(data[68:], ContentFreeList)
+	be.PutUint32(data[72:], 32)
+	mapper := NewMemoryMapperFromBytes(data)
+	bf, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening big endian block file:", err)
+	}
+	if bf.ByteOrder() != binary.BigEndian {
+		t.Error("expected big endian byte order, got", bf.ByteOrder())
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != 2 {
+		t.Error("expected block 2 from the free-list, got", block, err)
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != 3 {
+		t.Error("expected new block 3, got", block, err)
+	}
+	if err := bf.FreeBlock(1); err != nil {
+		t.Fatal("Error while freeing block 1", err)
+	}
+	data = mapper.Bytes()
+	if v := be.Uint32(data[12:]); v != 1 {
+		t.Error("expected nextFree 1 in big endian, got", v)
+	}
+	if v := be.Uint32(data[16:]); v != 4 {
+		t.Error("expected highWater 4 in big endian, got", v)
+	}
+	if v := be.Uint32(data[32:]); v != BlockFileMagic {
+		t.Error("expected the magic of the free block in big endian, got", v)
+	}
+	if _, err := OpenBlockFileFromMapper(mapper); err != nil {
+		t.Error("Error while reopening big endian block file:", err)
+	}
+
+	// new block-files are little endian on all platforms
+	mapper2 := NewMemoryMapper(32)
+	bf2, err := CreateBlockFileInMapperWithSize(mapper2, 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if bf2.ByteOrder() != binary.LittleEndian {
+		t.Error("expected little endian byte order, got", bf2.ByteOrder())
+	}
+	if v := binary.LittleEndian.Uint32(mapper2.Bytes()); v != BlockFileMagic2 {
+		t.Error("expected the magic in little endian, got", v)
+	}
+}
+
+func TestUpgradeBlockFile(t *testing.T) {
+	// a block-file of version 1 with 3 blocks, and data in the header block
+	le := binary.LittleEndian
+	data := make([]byte, 3*64)
+	le.PutUint32(data[0:], BlockFileMagic)
+	le.PutUint32(data[8:], 64) // blocksize
+	copy(data[16:], "HEADER")
+	mapper := NewMemoryMapperFromBytes(data)
+
+	// files of version 1 are used as they are
+	bf, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file of version 1:", err)
+	}
+	if v := bf.Version(); v != 1 {
+		t.Error("expected version 1, got", v)
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		if s := string(data[:6]); s != "HEADER" {
+			t.Error("expected HEADER, got", s)
+		}
+		if len(data) != 48 {
+			t.Error("unexpected size of the header data", len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Error while mapping header", err)
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 3 {
+		t.Error("unexpected number of blocks", n, err)
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != 3 {
+		t.Error("expected new block 3, got", block, err)
+	}
+	if err := bf.FreeBlock(1); err != nil {
+		t.Error("Error while freeing block:", err)
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != 1 {
+		t.Error("expected free block 1, got", block, err)
+	}
+	if size := mapper.Size(); size != 4*64 {
+		t.Error("unexpected size of the file", size)
+	}
+	if err := bf.AttachWAL(NewMemoryMapper(0)); err != ErrOldFormat {
+		t.Error("expected ErrOldFormat, got", err)
+	}
+
+	if err := UpgradeBlockFileInMapper(mapper); err != nil {
+		t.Fatal("Error while upgrading block file:", err)
+	}
+	bf, err = OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening upgraded block file:", err)
+	}
+	if v := bf.Version(); v != BlockFileVersion {
+		t.Error("expected the current version, got", v)
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		if s := string(data[:6]); s != "HEADER" {
+			t.Error("expected HEADER, got", s)
+		}
+		if len(data) != 32 {
+			t.Error("unexpected size of the header data", len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Error while mapping header", err)
+	}
+	if n, err := bf.NumBlocks(); err != nil || n != 4 {
+		t.Error("unexpected number of blocks", n, err)
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != 4 {
+		t.Error("expected new block 4, got", block, err)
+	}
+	if err := UpgradeBlockFileInMapper(mapper); err != nil {
+		t.Error("Error while upgrading a current block file:", err)
+	}
+
+	// the data section of the header block must shrink
+	data = make([]byte, 64)
+	le.PutUint32(data[0:], BlockFileMagic)
+	le.PutUint32(data[8:], 64)
+	data[63] = 1
+	if err := UpgradeBlockFileInMapper(NewMemoryMapperFromBytes(data)); err == nil {
+		t.Error("expected an error, when the header data does not fit")
+	}
+}
+
+func TestBlockFileFeatures(t *testing.T) {
+	mapper := NewMemoryMapper(32)
+	if _, err := CreateBlockFileInMapperWithSize(mapper, 32); err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	data := mapper.Bytes()
+	// unknown compatible features are ignored
+	binary.LittleEndian.PutUint32(data[24:], 1<<31)
+	if _, err := OpenBlockFileFromMapper(mapper); err != nil {
+		t.Error("Error while opening block file with unknown compatible features:", err)
+	}
+	// unknown incompatible features are refused
+	binary.LittleEndian.PutUint32(data[28:], 1<<31)
+	_, err := OpenBlockFileFromMapper(mapper)
+	if ferr, ok := err.(*UnsupportedFeaturesError); !ok || ferr.Features != 1<<31 {
+		t.Error("expected an UnsupportedFeaturesError, got", err)
+	}
+	// newer versions are refused
+	binary.LittleEndian.PutUint32(data[28:], 0)
+	binary.LittleEndian.PutUint32(data[20:], BlockFileVersion+1)
+	if _, err := OpenBlockFileFromMapper(mapper); err == nil {
+		t.Error("expected an error for a newer version")
+	}
+}
+
+func TestBlockFileLargeBlockIndices(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	if _, err := CreateBlockFileInMapperWithOptions(mapper, 32, LargeBlockIndices()); err == nil {
+		t.Error("expected an error for a blocksize smaller than the large header")
+	}
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 64, LargeBlockIndices())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if compat, incompat := bf.Features(); compat != 0 || incompat != IncompatLargeIndex {
+		t.Errorf("unexpected features %#x %#x", compat, incompat)
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		if len(data) != 64-40 {
+			t.Error("unexpected size of the header data", len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Error while mapping header:", err)
+	}
+	blocks, err := bf.AllocateBlocks(3)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	if _, err := bf.FreeBlocks([]int{blocks[0], blocks[2]}); err != nil {
+		t.Fatal("Error while freeing blocks:", err)
+	}
+
+	bf2, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if _, incompat := bf2.Features(); incompat != IncompatLargeIndex {
+		t.Error("the feature was not stored in the file")
+	}
+	if n, err := bf2.NumBlocks(); err != nil || n != 4 {
+		t.Error("unexpected number of blocks", n, err)
+	}
+	// the upper halfs of the block indices are stored separately
+	data := mapper.Bytes()
+	binary.LittleEndian.PutUint32(data[32:], 1)
+	binary.LittleEndian.PutUint32(data[64*blocks[2]+16:], 1)
+	if int64(^uint(0)>>1) > math.MaxUint32 {
+		if n, err := bf2.NumBlocks(); err != nil || int64(n) != 1<<32+4 {
+			t.Error("unexpected number of blocks", n, err)
+		}
+	} else if _, err := bf2.NumBlocks(); err != ErrBlockIndexOverflow {
+		t.Error("expected ErrBlockIndexOverflow, got", err)
+	}
+	binary.LittleEndian.PutUint32(data[32:], 0)
+	if block, err := bf2.AllocateBlock(); err != nil || block != blocks[2] {
+		t.Fatal("Error while allocating a free block:", block, err)
+	}
+	if _, err := bf2.AllocateBlock(); err == nil {
+		t.Error("expected an error for a free-list entry beyond the end of the file")
+	}
+}
+
+func TestBlockFileIndexOverflow(t *testing.T) {
+	mapper := NewMemoryMapper(32)
+	bf, err := CreateBlockFileInMapperWithSize(mapper, 32)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	// pretend, that all 32-bit block indices are used
+	binary.LittleEndian.PutUint32(mapper.Bytes()[16:], math.MaxUint32)
+	if _, err := bf.AllocateBlock(); err != ErrBlockIndexOverflow {
+		t.Error("expected ErrBlockIndexOverflow, got", err)
+	}
+	if block := int64(math.MaxUint32); int64(^uint(0)>>1) > block {
+		err := bf.MapBlock(int(block), func(data []byte) error { return nil })
+		if err != ErrBlockIndexOverflow {
+			t.Error("expected ErrBlockIndexOverflow, got", err)
+		}
+	}
+}
+
+func TestBlockFileChecksums(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 64, WithChecksums())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	bf.SetVerifyChecksums(true)
+	if bf.BlockDataSize() != 60 {
+		t.Error("unexpected block data size", bf.BlockDataSize())
+	}
+	blocks, err := bf.AllocateBlocks(2)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	// new blocks are sealed
+	err = bf.MapBlock(blocks[0], func(data []byte) error {
+		if len(data) != 60 {
+			t.Error("unexpected size of the block data", len(data))
+		}
+		copy(data, "hello")
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping a new block:", err)
+	}
+	// changes are detected until the block is sealed
+	err = bf.MapBlock(blocks[0], func(data []byte) error { return nil })
+	if cerr, ok := err.(*ChecksumMismatchError); !ok || cerr.Block != blocks[0] || !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("expected a ChecksumMismatchError, got", err)
+	}
+	if err := bf.SealBlock(blocks[0]); err != nil {
+		t.Fatal("Error while sealing block:", err)
+	}
+	if err := bf.VerifyBlock(blocks[0]); err != nil {
+		t.Error("Error while verifying a sealed block:", err)
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		if len(data) != 64-32-4 {
+			t.Error("unexpected size of the header data", len(data))
+		}
+		data[0] = 42
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping header:", err)
+	}
+	if err := bf.VerifyBlock(0); !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("expected ErrChecksumMismatch for the header block, got", err)
+	}
+	if err := bf.SealHeader(); err != nil {
+		t.Fatal("Error while sealing header:", err)
+	}
+	// freeing and allocating keeps the headers sealed
+	if err := bf.FreeBlock(blocks[1]); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	for _, block := range []int{0, blocks[0], blocks[1]} {
+		if err := bf.VerifyBlock(block); err != nil {
+			t.Error("Error while verifying block:", err)
+		}
+	}
+	if block, err := bf.AllocateBlock(); err != nil || block != blocks[1] {
+		t.Fatal("Error while allocating a free block:", block, err)
+	}
+	if err := bf.VerifyBlock(0); err != nil {
+		t.Error("Error while verifying header block:", err)
+	}
+
+	// atomic values can only be loaded, because they would break the checksum
+	if err := bf.StoreUint32(blocks[0], 8, 1); err != ErrChecksummedValue {
+		t.Error("expected ErrChecksummedValue, got", err)
+	}
+	if _, err := bf.SharedMutexAt(blocks[0], 8); err != ErrChecksummedValue {
+		t.Error("expected ErrChecksummedValue, got", err)
+	}
+	if _, err := bf.LoadUint32(blocks[0], 8); err != nil {
+		t.Error("Error while loading:", err)
+	}
+	if err := bf.VerifyBlock(blocks[0]); err != nil {
+		t.Error("Error while verifying block:", err)
+	}
+
+	// bit rot
+	mapper.Bytes()[64*blocks[0]+1] ^= 1
+	bf2, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if err := bf2.MapBlock(blocks[0], func(data []byte) error { return nil }); err != nil {
+		t.Error("checksums must not be verified by default:", err)
+	}
+	bf2.SetVerifyChecksums(true)
+	if err := bf2.MapBlock(blocks[0], func(data []byte) error { return nil }); !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("expected ErrChecksumMismatch, got", err)
+	}
+}
@@ -0,0 +1,163 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrChecksumMismatch is matched (with errors.Is) by the errors, that are
+// returned when the checksum of a block does not match its content.
+var ErrChecksumMismatch = errors.New("BlockFile: checksum mismatch")
+
+// ChecksumMismatchError is returned by MapBlock, MapHeader and VerifyBlock,
+// when the checksum of a block does not match its content (see
+// SetVerifyChecksums).
+type ChecksumMismatchError struct {
+	Block    int    // the index of the block (0 for the header block)
+	Stored   uint32 // the checksum, that is stored in the block
+	Computed uint32 // the checksum of the content of the block
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("BlockFile: checksum mismatch in block %d (stored %#08x, computed %#08x)", e.Block, e.Stored, e.Computed)
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// The checksums of a block-file with IncompatChecksums are CRC32C
+// (Castagnoli) checksums, that are stored in the last 4 bytes of each block,
+// in the byte order of the headers. The checksum covers the rest of the block.
+// So the slices, that are passed to the handlers of MapBlock and MapHeader,
+// are 4 bytes smaller (see BlockDataSize).
+//
+// The headers, that are written by BlockFile itself (the header block, the
+// free-list entries and new blocks from AllocateBlock), are sealed
+// automatically. Changes to the content of a block must be sealed by
+// SealBlock (or SealHeader) before the block is verified.
+
+const bfChecksumSize = 4
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize returns the size of the checksum at the end of each block, or
+// 0 without IncompatChecksums.
+func (bf *BlockFile) checksumSize() int {
+	if bf.incompat&IncompatChecksums != 0 {
+		return bfChecksumSize
+	}
+	return 0
+}
+
+// BlockDataSize returns the size of the slices, that are passed to the
+// handlers of MapBlock. This is the blocksize, minus the size of the checksum
+// with IncompatChecksums.
+func (bf *BlockFile) BlockDataSize() int {
+	return int(bf.blocksize) - bf.checksumSize()
+}
+
+// SetVerifyChecksums enables or disables the verification of the checksums by
+// MapBlock and MapHeader. The handlers are not called, when the checksum does
+// not match, and a *ChecksumMismatchError is returned. The verification is
+// disabled by default, and has no effect without IncompatChecksums.
+func (bf *BlockFile) SetVerifyChecksums(verify bool) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.verify = verify
+}
+
+// SealBlock computes the checksum of the content of the given block, and
+// stores it in the block. Block-index 0 is the header block. It must be called
+// after the content of a block was changed, and before the block is verified.
+// Without IncompatChecksums, it does nothing.
+// It returns an error, if any.
+func (bf *BlockFile) SealBlock(block int) error {
+	if bf.checksumSize() == 0 {
+		return nil
+	}
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+	if bf.hasShadowPaging() {
+		return ErrShadowPaging
+	}
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.mapper.Map(off, int(bf.blocksize), func(data []byte) error {
+		bf.preserve(block, data)
+		bf.setChecksum(data)
+		return nil
+	})
+}
+
+// SealHeader computes the checksum of the header block, and stores it (see
+// SealBlock).
+func (bf *BlockFile) SealHeader() error {
+	return bf.SealBlock(0)
+}
+
+// VerifyBlock verifies the checksum of the given block, independent of
+// SetVerifyChecksums. Block-index 0 is the header block. Without
+// IncompatChecksums, it does nothing.
+// It returns a *ChecksumMismatchError, when the checksum does not match.
+func (bf *BlockFile) VerifyBlock(block int) error {
+	if bf.checksumSize() == 0 {
+		return nil
+	}
+	off, err := bf.blockOffset(block)
+	if err != nil {
+		return err
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.mapper.Map(off, int(bf.blocksize), func(data []byte) error {
+		return bf.verifyChecksum(block, data)
+	})
+}
+
+// setChecksum stores the checksum of the mapped block at its end.
+func (bf *BlockFile) setChecksum(data []byte) {
+	if bf.checksumSize() == 0 {
+		return
+	}
+	end := len(data) - bfChecksumSize
+	bf.order.PutUint32(data[end:], crc32.Checksum(data[:end], crc32cTable))
+}
+
+// verifyChecksum compares the checksum, that is stored at the end of the
+// mapped block, with the checksum of its content.
+func (bf *BlockFile) verifyChecksum(block int, data []byte) error {
+	if bf.checksumSize() == 0 {
+		return nil
+	}
+	end := len(data) - bfChecksumSize
+	stored := bf.order.Uint32(data[end:])
+	if computed := crc32.Checksum(data[:end], crc32cTable); computed != stored {
+		return &ChecksumMismatchError{Block: block, Stored: stored, Computed: computed}
+	}
+	return nil
+}
+
+// sealNewBlocks seals the given number of (zeroed) blocks, starting with the
+// given block-index.
+func (bf *BlockFile) sealNewBlocks(raw rawBlockMapper, first int, n int) error {
+	if bf.checksumSize() == 0 {
+		return nil
+	}
+	for block := first; block < first+n; block++ {
+		err := raw.mapRawBlock(block, func(data []byte) error {
+			bf.setChecksum(data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"unsafe"
+)
+
+// ErrMappingFault is matched (with errors.Is) by the errors, that are returned
+// when accessing the mapped memory causes a fault (see SafeAccess).
+var ErrMappingFault = errors.New("MappedFile: fault while accessing the mapped memory")
+
+// MappingFaultError is returned by MappedFile.Map, ReadAt, WriteAt, Read and
+// Write, when accessing the mapped memory caused a fault, and the MappedFile
+// was opened with the SafeAccess option. This happens for example, when the
+// file was truncated by an other process, or when the disk is full.
+type MappingFaultError struct {
+	Offset int64 // the offset in the mapped memory, where the fault occurred
+	Err    error // the runtime error
+}
+
+func (e *MappingFaultError) Error() string {
+	return fmt.Sprintf("MappedFile: fault while accessing the mapped memory at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *MappingFaultError) Is(target error) bool {
+	return target == ErrMappingFault
+}
+
+func (e *MappingFaultError) Unwrap() error {
+	return e.Err
+}
+
+// safeCopy copies src to dst like copy. With SafeAccess, faults on the mapped
+// memory are returned as a *MappingFaultError.
+func (mf *MappedFile) safeCopy(dst, src []byte) (n int, err error) {
+	if !mf.safeAccess {
+		return copy(dst, src), nil
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer mf.recoverFault(&err)
+	return copy(dst, src), nil
+}
+
+// safeCall calls the handler with the given slice. With SafeAccess, faults on
+// the mapped memory are returned as a *MappingFaultError.
+func (mf *MappedFile) safeCall(data []byte, handler func([]byte) error) (err error) {
+	if !mf.safeAccess {
+		return handler(data)
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer mf.recoverFault(&err)
+	return handler(data)
+}
+
+// recoverFault recovers from a panic that was caused by a fault on the mapped
+// memory, and stores it as error. Other panics are passed on.
+func (mf *MappedFile) recoverFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if fault, ok := r.(interface {
+		error
+		Addr() uintptr
+	}); ok && len(mf.data) > 0 {
+		base := uintptr(unsafe.Pointer(&mf.data[0]))
+		if addr := fault.Addr(); addr >= base && addr-base < uintptr(len(mf.data)) {
+			*err = &MappingFaultError{Offset: int64(addr - base), Err: fault}
+			return
+		}
+	}
+	panic(r)
+}
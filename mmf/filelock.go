@@ -0,0 +1,134 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrFileLocked is returned when opening a file with WithFileLockNoWait, if
+// the file is locked by someone else.
+var ErrFileLocked = errors.New("MappedFile: file is locked")
+
+// The file locks are advisory: they only exclude others, that use the file
+// locks too, but they don't prevent accesses to the file or the mapped memory.
+// On Linux, open file description locks are used, which are owned by the
+// opened file. On other Unix platforms, these are POSIX record locks, which are
+// owned by the process: they don't exclude each other within the same
+// process, and they are released when any descriptor of the file is closed by
+// the process. On Windows, LockFileEx is used. All file locks are released by
+// Close. On Unix, exclusive locks require a file, that is opened for writing.
+
+// LockFile acquires an exclusive lock on the whole file, and waits until the
+// lock is available.
+// It returns an error, if any.
+func (mf *MappedFile) LockFile() error {
+	return mf.lockFile(0, 0, true, true)
+}
+
+// RLockFile acquires a shared lock on the whole file, and waits until the lock
+// is available.
+// It returns an error, if any.
+func (mf *MappedFile) RLockFile() error {
+	return mf.lockFile(0, 0, false, true)
+}
+
+// TryLockFile tries to acquire an exclusive lock on the whole file without
+// waiting. It returns false, if the file is locked by someone else.
+func (mf *MappedFile) TryLockFile() (bool, error) {
+	return mf.tryLockFile(0, 0, true)
+}
+
+// TryRLockFile tries to acquire a shared lock on the whole file without
+// waiting. It returns false, if the file is exclusively locked by someone else.
+func (mf *MappedFile) TryRLockFile() (bool, error) {
+	return mf.tryLockFile(0, 0, false)
+}
+
+// UnlockFile releases the lock on the whole file, that was acquired by
+// LockFile or RLockFile.
+// It returns an error, if any.
+func (mf *MappedFile) UnlockFile() error {
+	f, err := mf.lockableFile()
+	if err != nil {
+		return err
+	}
+	return unlockFile(f)
+}
+
+// LockFileRange acquires an exclusive or shared lock on the given byte-range
+// of the file, and waits until the lock is available. The range may extend
+// beyond the end of the file. Don't mix range locks with locks on the whole
+// file.
+// It returns an error, if any.
+func (mf *MappedFile) LockFileRange(off, length int64, exclusive bool) error {
+	if err := checkFileRange(off, length); err != nil {
+		return err
+	}
+	return mf.lockFile(off, length, exclusive, true)
+}
+
+// TryLockFileRange tries to acquire an exclusive or shared lock on the given
+// byte-range of the file without waiting (see LockFileRange). It returns false,
+// if the range is locked by someone else.
+func (mf *MappedFile) TryLockFileRange(off, length int64, exclusive bool) (bool, error) {
+	if err := checkFileRange(off, length); err != nil {
+		return false, err
+	}
+	return mf.tryLockFile(off, length, exclusive)
+}
+
+// UnlockFileRange releases the lock on the given byte-range, that was acquired
+// by LockFileRange. The range must match the locked range.
+// It returns an error, if any.
+func (mf *MappedFile) UnlockFileRange(off, length int64) error {
+	if err := checkFileRange(off, length); err != nil {
+		return err
+	}
+	f, err := mf.lockableFile()
+	if err != nil {
+		return err
+	}
+	return unlockFileRange(f, off, length)
+}
+
+func (mf *MappedFile) lockFile(off, length int64, exclusive, wait bool) error {
+	f, err := mf.lockableFile()
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		_, err = lockFile(f, exclusive, wait)
+	} else {
+		_, err = lockFileRange(f, off, length, exclusive, wait)
+	}
+	return err
+}
+
+func (mf *MappedFile) tryLockFile(off, length int64, exclusive bool) (bool, error) {
+	f, err := mf.lockableFile()
+	if err != nil {
+		return false, err
+	}
+	if length == 0 {
+		return lockFile(f, exclusive, false)
+	}
+	return lockFileRange(f, off, length, exclusive, false)
+}
+
+func (mf *MappedFile) lockableFile() (*os.File, error) {
+	if mf == nil || mf.data == nil {
+		return nil, errors.New("MappedFile: closed")
+	}
+	if mf.file == nil {
+		return nil, errors.New("MappedFile: anonymous mappings can't be locked")
+	}
+	return mf.file, nil
+}
+
+func checkFileRange(off, length int64) error {
+	if off < 0 || length <= 0 || off+length < off {
+		return fmt.Errorf("MappedFile: invalid lock range %d+%d", off, length)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package mmf
+
+import (
+	syscall "golang.org/x/sys/unix"
+)
+
+// Open file description locks are owned by the open file, and not by the
+// process, so they are not released when an other descriptor of the same
+// file is closed, and they exclude each other within the same process.
+const (
+	fcntlSetLock     = syscall.F_OFD_SETLK
+	fcntlSetLockWait = syscall.F_OFD_SETLKW
+)
@@ -0,0 +1,24 @@
+//go:build js || plan9 || wasip1
+// +build js plan9 wasip1
+
+package mmf
+
+import (
+	"os"
+)
+
+func lockFile(f *os.File, exclusive, wait bool) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func unlockFile(f *os.File) error {
+	return ErrNotSupported
+}
+
+func lockFileRange(f *os.File, off, length int64, exclusive, wait bool) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func unlockFileRange(f *os.File, off, length int64) error {
+	return ErrNotSupported
+}
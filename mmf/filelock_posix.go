@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !js && !plan9 && !wasip1
+// +build !linux,!windows,!js,!plan9,!wasip1
+
+package mmf
+
+import (
+	syscall "golang.org/x/sys/unix"
+)
+
+// POSIX record locks are owned by the process. They don't exclude each other
+// within the same process, and all of them are released, when any descriptor
+// of the file is closed by the process.
+const (
+	fcntlSetLock     = syscall.F_SETLK
+	fcntlSetLockWait = syscall.F_SETLKW
+)
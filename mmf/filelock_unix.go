@@ -0,0 +1,61 @@
+//go:build !windows && !js && !plan9 && !wasip1
+// +build !windows,!js,!plan9,!wasip1
+
+package mmf
+
+import (
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+// lockFile locks the whole file. When wait is false, it returns false, if the
+// lock is held by someone else.
+func lockFile(f *os.File, exclusive, wait bool) (bool, error) {
+	// a length of 0 extends the lock to the end of the file (even if it grows)
+	return lockFileRange(f, 0, 0, exclusive, wait)
+}
+
+func unlockFile(f *os.File) error {
+	return unlockFileRange(f, 0, 0)
+}
+
+func lockFileRange(f *os.File, off, length int64, exclusive, wait bool) (bool, error) {
+	lk := syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: 0, // io.SeekStart
+		Start:  off,
+		Len:    length,
+	}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	cmd := fcntlSetLock
+	if wait {
+		cmd = fcntlSetLockWait
+	}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), cmd, &lk)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN, syscall.EACCES:
+			if !wait {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+}
+
+func unlockFileRange(f *os.File, off, length int64) error {
+	lk := syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: 0, // io.SeekStart
+		Start:  off,
+		Len:    length,
+	}
+	return syscall.FcntlFlock(f.Fd(), fcntlSetLock, &lk)
+}
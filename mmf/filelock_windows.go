@@ -0,0 +1,37 @@
+package mmf
+
+import (
+	"math"
+	"os"
+
+	syscall "golang.org/x/sys/windows"
+)
+
+func lockFile(f *os.File, exclusive, wait bool) (bool, error) {
+	return lockFileRange(f, 0, math.MaxInt64, exclusive, wait)
+}
+
+func unlockFile(f *os.File) error {
+	return unlockFileRange(f, 0, math.MaxInt64)
+}
+
+func lockFileRange(f *os.File, off, length int64, exclusive, wait bool) (bool, error) {
+	var flags uint32
+	if exclusive {
+		flags |= syscall.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if !wait {
+		flags |= syscall.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	ol := syscall.Overlapped{Offset: uint32(off), OffsetHigh: uint32(off >> 32)}
+	err := syscall.LockFileEx(syscall.Handle(f.Fd()), flags, 0, uint32(length), uint32(length>>32), &ol)
+	if err == syscall.ERROR_LOCK_VIOLATION && !wait {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFileRange(f *os.File, off, length int64) error {
+	ol := syscall.Overlapped{Offset: uint32(off), OffsetHigh: uint32(off >> 32)}
+	return syscall.UnlockFileEx(syscall.Handle(f.Fd()), 0, uint32(length), uint32(length>>32), &ol)
+}
@@ -6,5 +6,25 @@ import (
 	syscall "golang.org/x/sys/unix"
 )
 
-const createFlags = os.O_RDWR | os.O_CREATE | syscall.O_NOATIME | os.O_TRUNC
-const openFlags = os.O_RDWR | os.O_CREATE | syscall.O_NOATIME
+const rwFlags = os.O_RDWR | syscall.O_NOATIME
+
+// O_NOATIME is left out, because it requires the ownership of the file, which
+// is not always given for files that are opened for reading only.
+const readOnlyFlags = os.O_RDONLY
+
+const mapPopulate = syscall.MAP_POPULATE
+
+const (
+	madvHugePage   = syscall.MADV_HUGEPAGE
+	madvNoHugePage = syscall.MADV_NOHUGEPAGE
+	madvFree       = syscall.MADV_FREE
+)
+
+// memlockLimit returns the limit of locked memory (RLIMIT_MEMLOCK).
+func memlockLimit() uint64 {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_MEMLOCK, &rlim); err != nil {
+		return 0
+	}
+	return rlim.Cur
+}
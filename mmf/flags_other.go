@@ -6,5 +6,18 @@ import (
 	"os"
 )
 
-const createFlags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
-const openFlags = os.O_RDWR | os.O_CREATE
+const rwFlags = os.O_RDWR
+const readOnlyFlags = os.O_RDONLY
+
+const mapPopulate = 0 // not supported
+
+const (
+	madvHugePage   = -1 // not supported
+	madvNoHugePage = -1 // not supported
+	madvFree       = -1 // not supported
+)
+
+// memlockLimit returns the limit of locked memory, or 0 if it is unknown.
+func memlockLimit() uint64 {
+	return 0
+}
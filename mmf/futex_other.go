@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package mmf
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// There is no futex, that is shared between processes, on this platform. So
+// waiting falls back to sleeping and polling the value.
+const futexPollInterval = 100 * time.Microsecond
+
+func futexWait(addr *uint32, val uint32, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for sleep := futexPollInterval; atomic.LoadUint32(addr) == val; sleep *= 2 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		if sleep > remaining {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+	}
+}
+
+func futexWake(addr *uint32, n int) {
+	// the waiters are polling
+}
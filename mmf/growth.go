@@ -0,0 +1,56 @@
+package mmf
+
+// GrowthPolicy decides how many blocks a BlockFile should have after growing.
+// It gets the current number of blocks in the Mapper, and the number of
+// blocks that are at least required. When the returned value is lower than
+// required, required is used.
+//
+// Growing the Mapper usually requires a remap of the file, so growing
+// geometrically reduces the number of remaps, when many blocks are allocated.
+type GrowthPolicy func(blocks, required int64) int64
+
+// GrowExact returns a GrowthPolicy, that grows the Mapper exactly to the
+// number of required blocks. This is the default.
+func GrowExact() GrowthPolicy {
+	return func(blocks, required int64) int64 {
+		return required
+	}
+}
+
+// GrowByChunk returns a GrowthPolicy, that grows the Mapper in multiples of
+// the given number of blocks.
+func GrowByChunk(chunk int64) GrowthPolicy {
+	if chunk < 1 {
+		chunk = 1
+	}
+	return func(blocks, required int64) int64 {
+		return (required + chunk - 1) / chunk * chunk
+	}
+}
+
+// GrowByDoubling returns a GrowthPolicy, that doubles the number of blocks
+// until the required number of blocks fit.
+func GrowByDoubling() GrowthPolicy {
+	return GrowByCappedDoubling(0)
+}
+
+// GrowByCappedDoubling returns a GrowthPolicy, that doubles the number of
+// blocks, but adds at most maxBlocks at once. When maxBlocks is <= 0, the
+// growth is not capped.
+func GrowByCappedDoubling(maxBlocks int64) GrowthPolicy {
+	return func(blocks, required int64) int64 {
+		newBlocks := blocks
+		if newBlocks < 1 {
+			newBlocks = 1
+		}
+		for newBlocks < required {
+			if maxBlocks > 0 && newBlocks >= maxBlocks {
+				// grow linearly by maxBlocks
+				steps := (required - newBlocks + maxBlocks - 1) / maxBlocks
+				return newBlocks + steps*maxBlocks
+			}
+			newBlocks *= 2
+		}
+		return newBlocks
+	}
+}
@@ -0,0 +1,81 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MemlockLimitError is returned by MappedFile.Lock, when the pages can't be
+// locked, because this would exceed the limit of locked memory of the process
+// (RLIMIT_MEMLOCK on Unix, the minimum working set size on Windows).
+type MemlockLimitError struct {
+	Length int    // the number of bytes that should be locked
+	Limit  uint64 // the limit in bytes, or 0 if it is unknown
+	Err    error  // the error of the system call
+}
+
+func (e *MemlockLimitError) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("MappedFile: unable to lock %d bytes: limit of locked memory exceeded: %v", e.Length, e.Err)
+	}
+	return fmt.Sprintf("MappedFile: unable to lock %d bytes: limit of locked memory (%d bytes) exceeded: %v", e.Length, e.Limit, e.Err)
+}
+
+func (e *MemlockLimitError) Unwrap() error {
+	return e.Err
+}
+
+// Lock locks the given range of the mapped memory in RAM, so that it is not
+// paged out. The range is extended to page boundaries. The locks are released
+// by Unlock, Truncate and Close. When the limit of locked memory is exceeded,
+// a *MemlockLimitError is returned.
+// It returns an error, if any.
+func (mf *MappedFile) Lock(off int64, length int) error {
+	b, err := mf.pageAlignedRange(off, length, "Lock")
+	if err != nil || b == nil {
+		return err
+	}
+	return mf.mlock(b)
+}
+
+// Unlock unlocks the given range of the mapped memory, that was locked by
+// Lock or LockAll. The range is extended to page boundaries.
+// It returns an error, if any.
+func (mf *MappedFile) Unlock(off int64, length int) error {
+	b, err := mf.pageAlignedRange(off, length, "Unlock")
+	if err != nil || b == nil {
+		return err
+	}
+	return mf.munlock(b)
+}
+
+// LockAll locks the whole mapped memory in RAM (see Lock).
+// It returns an error, if any.
+func (mf *MappedFile) LockAll() error {
+	return mf.Lock(0, mf.Size())
+}
+
+// UnlockAll unlocks the whole mapped memory (see Unlock).
+// It returns an error, if any.
+func (mf *MappedFile) UnlockAll() error {
+	return mf.Unlock(0, mf.Size())
+}
+
+// pageAlignedRange returns the given range of the mapped memory extended to
+// page boundaries, or nil if the range is empty.
+func (mf *MappedFile) pageAlignedRange(off int64, length int, op string) ([]byte, error) {
+	if mf == nil || mf.data == nil {
+		return nil, errors.New("MappedFile: closed")
+	}
+	if off < 0 || length < 0 || int64(len(mf.data)) < off+int64(length) {
+		return nil, fmt.Errorf("MappedFile: invalid %s offset %d", op, off)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	start, end := pageRange(int(off), length)
+	if end > len(mf.data) {
+		end = len(mf.data)
+	}
+	return mf.data[start:end], nil
+}
@@ -16,6 +16,14 @@ const (
 
 const defaultMode os.FileMode = 0666
 
+// ErrReadOnly is returned by the modifying methods of a MappedFile (or a
+// BlockFile) that was opened in read-only mode.
+var ErrReadOnly = errors.New("MappedFile: read-only")
+
+// ErrNotSupported is returned when an operation is not supported on the
+// current platform.
+var ErrNotSupported = errors.New("MappedFile: not supported on this platform")
+
 // CreateMappedFile creates a new file (or replaces an existing one) with the
 // given initial size. The file is then mapped to memory. The mapped memory is
 // Readable and Writeable. The operating system will write the changes to the
@@ -23,22 +31,59 @@ const defaultMode os.FileMode = 0666
 // the mapped memory for will be shared between the processes.
 // It returns an error, if any.
 func CreateMappedFile(filename string, size int64) (*MappedFile, error) {
-	if size < 0 {
-		return nil, fmt.Errorf("MappedFile: requested file size is negative")
-	}
-	if size != int64(int(size)) {
-		return nil, fmt.Errorf("MappedFile: requested file size is too large")
+	return OpenMappedFileWithOptions(filename, CreateIfMissing(), TruncateExisting(), WithSize(size))
+}
+
+// OpenMappedFile opens an existing file and maps it to memory. The mapped
+// memory is Readable and Writeable. The operating system will write the changes
+// to the file at some point later. When multiple processes open the same file,
+// the mapped memory for will be shared between the processes.
+// It returns an error, if any.
+func OpenMappedFile(filename string) (*MappedFile, error) {
+	return OpenMappedFileWithOptions(filename, CreateIfMissing())
+}
+
+// OpenMappedFileReadOnly opens an existing file and maps it to memory. The
+// mapped memory is only Readable, so the file can be located on a read-only
+// filesystem or can be a file we don't have write permissions for. Unlike
+// OpenMappedFile, it fails when the file does not exist.
+// Write, WriteAt, WriteByte and Truncate return ErrReadOnly. Writing to the
+// slices returned by Bytes or passed to a Map handler causes a fault.
+// It returns an error, if any.
+func OpenMappedFileReadOnly(filename string) (*MappedFile, error) {
+	return OpenMappedFileWithOptions(filename, ReadOnly())
+}
+
+// OpenMappedFileCopyOnWrite opens an existing file and maps it to memory as a
+// private copy-on-write mapping (see the Private option). The mapped memory is
+// Readable and Writeable, but the changes are never written back to the file
+// and are discarded on Close. The file itself is opened for reading only.
+// It returns an error, if any.
+func OpenMappedFileCopyOnWrite(filename string) (*MappedFile, error) {
+	return OpenMappedFileWithOptions(filename, Private())
+}
+
+// OpenMappedFileWithOptions opens a file and maps it to memory. How the file
+// is opened and mapped is configured by the given options. Without any
+// options, the file must exist, and is mapped Readable, Writeable and shared
+// like by OpenMappedFile.
+// It returns an error, if any.
+func OpenMappedFileWithOptions(filename string, opts ...Option) (*MappedFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
 	}
-	f, err := os.OpenFile(filename, createFlags, defaultMode)
-	if err != nil {
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
-	err = f.Truncate(size)
+	if o.size != int64(int(o.size)) {
+		return nil, fmt.Errorf("MappedFile: requested file size is too large")
+	}
+	f, err := o.openFile(filename)
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
-	mf, err := openMappedFile(f, int(size))
+	mf, err := mapOpenedFile(f, &o)
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -46,41 +91,87 @@ func CreateMappedFile(filename string, size int64) (*MappedFile, error) {
 	return mf, nil
 }
 
-// OpenMappedFile opens an existing file and maps it to memory. The mapped
-// memory is Readable and Writeable. The operating system will write the changes
-// to the file at some point later. When multiple processes open the same file,
-// the mapped memory for will be shared between the processes.
+// OpenMappedFileFromFile maps an already opened file to memory. This can be
+// used for mapping a file descriptor that was inherited from a parent process
+// (see NewMemfdMapping). Options that control how the file is opened are
+// ignored, so only WithSize, WithProtection, ReadOnly, Shared, Private,
+// Populate, WithFileLock and WithFileLockNoWait have an effect. The protection
+// must match the mode the file was opened with.
+// On success, the MappedFile takes ownership of the file and closes it on
+// Close.
 // It returns an error, if any.
-func OpenMappedFile(filename string) (*MappedFile, error) {
-	f, err := os.OpenFile(filename, openFlags, defaultMode)
-	if err != nil {
+func OpenMappedFileFromFile(file *os.File, opts ...Option) (*MappedFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
+	if o.size != int64(int(o.size)) {
+		return nil, fmt.Errorf("MappedFile: requested file size is too large")
+	}
+	if o.size != -1 && o.prot&ProtWrite == 0 {
+		return nil, fmt.Errorf("MappedFile: unable to create or resize a read-only file")
+	}
+	writer := o.prot&ProtWrite != 0 && (!o.private || o.size != -1)
+	if err := o.lockFile(file, writer); err != nil {
+		return nil, err
+	}
+	mf, err := mapOpenedFile(file, &o)
+	if err != nil && o.fileLock != noFileLock {
+		unlockFile(file)
+	}
+	return mf, err
+}
+
+func mapOpenedFile(f *os.File, o *options) (*MappedFile, error) {
 	fi, err := f.Stat()
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
 	size := fi.Size()
+	if o.size != -1 {
+		if err := growFile(f, size, o.size, o.preallocate); err != nil {
+			return nil, err
+		}
+		size = o.size
+	}
 	if size < 0 {
-		f.Close()
-		return nil, fmt.Errorf("MappedFile: file %q has negative size", filename)
+		return nil, fmt.Errorf("MappedFile: file %q has negative size", f.Name())
 	}
 	if size != int64(int(size)) {
-		f.Close()
-		return nil, fmt.Errorf("MappedFile: file %q is too large", filename)
+		return nil, fmt.Errorf("MappedFile: file %q is too large", f.Name())
 	}
-	mf, err := openMappedFile(f, int(size))
-	if err != nil {
-		f.Close()
+	return openMappedFile(f, int(size), o)
+}
+
+func openMappedFile(file *os.File, size int, o *options) (*MappedFile, error) {
+	if o.reserve != 0 && int64(size) > o.reserve {
+		return nil, fmt.Errorf("MappedFile: file %q exceeds the reserved address space", file.Name())
+	}
+	mf := &MappedFile{file: file, prot: o.prot, private: o.private, populate: o.populate, reserve: int(o.reserve), preallocate: o.preallocate, safeAccess: o.safeAccess}
+	if err := mf.mmap(size); err != nil {
 		return nil, err
 	}
+	runtime.SetFinalizer(mf, (*MappedFile).Close)
 	return mf, nil
 }
 
-func openMappedFile(file *os.File, size int) (*MappedFile, error) {
-	mf := &MappedFile{file: file}
-	if err := mf.mmap(size); err != nil {
+// NewAnonymousMapping creates a new mapping of the given size, that is not
+// backed by a file. The mapped memory is Readable and Writeable, and is
+// initialized with zeros. It is private to the process, and is released on
+// Close. Truncate copies the content to a new mapping with the requested size.
+// It returns an error, if any.
+func NewAnonymousMapping(size int64) (*MappedFile, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("MappedFile: requested size is negative")
+	}
+	if size != int64(int(size)) {
+		return nil, fmt.Errorf("MappedFile: requested size is too large")
+	}
+	mf := &MappedFile{prot: ProtRead | ProtWrite, private: true}
+	if err := mf.remapAnonymous(int(size)); err != nil {
 		return nil, err
 	}
 	runtime.SetFinalizer(mf, (*MappedFile).Close)
@@ -106,28 +197,71 @@ func (mf *MappedFile) Close() error {
 	return nil
 }
 
-// Sync tells the operating system to write the changes back to the file soon.
+// Sync writes the changes of the whole mapped memory back to the file, and
+// waits until they are written.
+// For read-only and private mappings, there is nothing to write back.
 // It returns an error, if any.
 func (mf *MappedFile) Sync() error {
-	if mf == nil || mf.data == nil || mf.file == nil {
-		return errors.New("MappedFile: closed")
+	return mf.SyncRange(0, mf.Size(), false)
+}
+
+// SyncAsync tells the operating system to write the changes of the whole
+// mapped memory back to the file soon, without waiting for it.
+// It returns an error, if any.
+func (mf *MappedFile) SyncAsync() error {
+	return mf.SyncRange(0, mf.Size(), true)
+}
+
+// SyncRange writes the changes of the given range of the mapped memory back
+// to the file. The range is extended to page boundaries. When async is true,
+// it doesn't wait until the changes are written.
+// For read-only and private mappings, there is nothing to write back.
+// It returns an error, if any.
+func (mf *MappedFile) SyncRange(off int64, length int, async bool) error {
+	b, err := mf.pageAlignedRange(off, length, "SyncRange")
+	if err != nil || b == nil {
+		return err
+	}
+	if mf.prot&ProtWrite == 0 || mf.private {
+		// there are no changes to write back
+		return nil
 	}
-	return mf.sync(false)
+	return mf.sync(b, async)
 }
 
 // Truncate changes the size of the file and the mapped memory area.
-// The (virtual-)address of the mapped memory area will possibly change.
+// The (virtual-)address of the mapped memory area will possibly change, unless
+// address space was reserved with the ReserveAddressSpace option.
+// With the Preallocate option, the disk space is reserved before the file
+// grows, so that a full disk is reported as an error.
+// For private copy-on-write mappings, the file is left untouched: the mapped
+// memory is copied to a new anonymous mapping with the requested size instead.
 // It returns an error, if any.
 func (mf *MappedFile) Truncate(size int64) error {
-	if mf == nil || mf.data == nil || mf.file == nil {
+	if mf == nil || mf.data == nil {
 		return errors.New("MappedFile: closed")
 	}
+	if mf.prot&ProtWrite == 0 {
+		return ErrReadOnly
+	}
 	if size < 0 {
 		return fmt.Errorf("MappedFile: requested file size is negative")
 	}
 	if size != int64(int(size)) {
 		return fmt.Errorf("MappedFile: requested file size is too large")
 	}
+	if mf.reserve != 0 {
+		return mf.resizeReserved(int(size))
+	}
+	if mf.private {
+		return mf.remapAnonymous(int(size))
+	}
+	if mf.preallocate && size > int64(len(mf.data)) {
+		// reserve the disk space, before the mapping is changed
+		if err := growFile(mf.file, int64(len(mf.data)), size, true); err != nil {
+			return err
+		}
+	}
 	if err := mf.munmap(); err != nil {
 		return err
 	}
@@ -142,7 +276,7 @@ func (mf *MappedFile) Truncate(size int64) error {
 
 // Fd returns the file descriptor handle referencing the open file.
 // The file descriptor is valid only until mf.Close is called or mf is
-// garbage collected.
+// garbage collected. For anonymous mappings, it returns ^uintptr(0).
 func (mf *MappedFile) Fd() uintptr {
 	if mf != nil && mf.file != nil {
 		return mf.file.Fd()
@@ -151,8 +285,14 @@ func (mf *MappedFile) Fd() uintptr {
 	}
 }
 
+// ReadOnly returns true, if the file was opened in read-only mode (see
+// OpenMappedFileReadOnly and the ReadOnly option).
+func (mf *MappedFile) ReadOnly() bool {
+	return mf != nil && mf.prot&ProtWrite == 0
+}
+
 // Name returns the name of the file as presented to CreateMappedFile or
-// OpenMappedFile.
+// OpenMappedFile. For anonymous mappings, it returns an empty string.
 func (mf *MappedFile) Name() string {
 	if mf != nil && mf.file != nil {
 		return mf.file.Name()
@@ -183,7 +323,8 @@ func (mf *MappedFile) Len() int {
 
 // Bytes returns a slice to the mapped memory area.
 // The slice is valid only until mf.Close or mf.Truncate is called or mf
-// is garbage collected.
+// is garbage collected. With the ReserveAddressSpace option, the slice stays
+// valid on mf.Truncate, as long as it doesn't shrink below the slice.
 func (mf *MappedFile) Bytes() []byte {
 	if mf != nil {
 		return mf.data
@@ -224,9 +365,9 @@ func (mf *MappedFile) Read(p []byte) (int, error) {
 	if mf.off >= len(mf.data) {
 		return 0, io.EOF
 	}
-	n := copy(p, mf.data[mf.off:])
+	n, err := mf.safeCopy(p, mf.data[mf.off:])
 	mf.off += n
-	return n, nil
+	return n, err
 }
 
 // ReadByte reads and returns the next byte from the mapped memory.
@@ -252,15 +393,18 @@ func (mf *MappedFile) Write(p []byte) (int, error) {
 	if mf == nil || mf.data == nil {
 		return 0, errors.New("MappedFile: closed")
 	}
+	if mf.prot&ProtWrite == 0 {
+		return 0, ErrReadOnly
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
 	if mf.off >= len(mf.data) {
 		return 0, io.EOF
 	}
-	n := copy(mf.data[mf.off:], p)
+	n, err := mf.safeCopy(mf.data[mf.off:], p)
 	mf.off += n
-	return n, nil
+	return n, err
 }
 
 // WriteByte writes the next byte to the mapped memory.
@@ -269,6 +413,9 @@ func (mf *MappedFile) WriteByte(c byte) error {
 	if mf == nil || mf.data == nil {
 		return errors.New("MappedFile: closed")
 	}
+	if mf.prot&ProtWrite == 0 {
+		return ErrReadOnly
+	}
 	if mf.off >= len(mf.data) {
 		return io.EOF
 	}
@@ -324,7 +471,10 @@ func (mf *MappedFile) ReadAt(b []byte, off int64) (int, error) {
 	if off < 0 || int64(len(mf.data)) < off {
 		return 0, fmt.Errorf("MappedFile: invalid ReadAt offset %d", off)
 	}
-	n := copy(b, mf.data[off:])
+	n, err := mf.safeCopy(b, mf.data[off:])
+	if err != nil {
+		return n, err
+	}
 	if n < len(b) {
 		return n, io.EOF
 	}
@@ -339,10 +489,16 @@ func (mf *MappedFile) WriteAt(b []byte, off int64) (int, error) {
 	if mf == nil || mf.data == nil {
 		return 0, errors.New("MappedFile: closed")
 	}
+	if mf.prot&ProtWrite == 0 {
+		return 0, ErrReadOnly
+	}
 	if off < 0 || int64(len(mf.data)) < off {
 		return 0, fmt.Errorf("MappedFile: invalid WriteAt offset %d", off)
 	}
-	n := copy(mf.data[off:], b)
+	n, err := mf.safeCopy(mf.data[off:], b)
+	if err != nil {
+		return n, err
+	}
 	if n < len(b) {
 		return n, io.EOF
 	}
@@ -350,12 +506,15 @@ func (mf *MappedFile) WriteAt(b []byte, off int64) (int, error) {
 }
 
 // Map calls the given handler with a slice at the given range.
+// When the file was opened in read-only mode, the handler must not write to
+// the slice. With the SafeAccess option, a fault while the handler accesses
+// the mapped memory is returned as a *MappingFaultError.
 func (mf *MappedFile) Map(off int64, length int, handler func([]byte) error) error {
 	if mf == nil || mf.data == nil {
 		return errors.New("MappedFile: closed")
 	}
-	if off < 0 || int64(len(mf.data)) < off+int64(length) {
-		return fmt.Errorf("MappedFile: invalid WriteAt offset %d", off)
+	if off < 0 || length < 0 || int64(len(mf.data)) < off+int64(length) {
+		return fmt.Errorf("MappedFile: invalid Map offset %d", off)
 	}
-	return handler(mf.data[int(off) : int(off)+length])
+	return mf.safeCall(mf.data[int(off):int(off)+length], handler)
 }
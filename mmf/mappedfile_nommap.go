@@ -0,0 +1,61 @@
+//go:build js || plan9 || wasip1
+// +build js plan9 wasip1
+
+package mmf
+
+import (
+	"os"
+)
+
+// MappedFile is a struct that defines an open memory mapped file.
+// This platform does not support memory mapped files, so only anonymous
+// mappings (see NewAnonymousMapping) can be created, which are backed by a
+// plain byte slice.
+type MappedFile struct {
+	data     []byte
+	off      int
+	file     *os.File
+	prot     Protection
+	private  bool
+	populate bool // not supported
+	reserve  int  // not supported
+
+	preallocate bool
+	safeAccess  bool
+}
+
+func (mf *MappedFile) mmap(size int) error {
+	return ErrNotSupported
+}
+
+func (mf *MappedFile) remapAnonymous(size int) error {
+	data := make([]byte, size)
+	copy(data, mf.data)
+	mf.data = data
+	return nil
+}
+
+func (mf *MappedFile) munmap() error {
+	mf.data = nil
+	return nil
+}
+
+func (mf *MappedFile) sync(b []byte, async bool) error {
+	return ErrNotSupported
+}
+
+func (mf *MappedFile) resizeReserved(size int) error {
+	return ErrNotSupported
+}
+
+func (mf *MappedFile) madvise(b []byte, advice Advice) error {
+	return ErrNotSupported
+}
+
+func (mf *MappedFile) mlock(b []byte) error {
+	return ErrNotSupported
+}
+
+func (mf *MappedFile) munlock(b []byte) error {
+	return ErrNotSupported
+}
@@ -1,7 +1,11 @@
 package mmf_test
 
 import (
+	"errors"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	. "github.com/HellButcher/go-mmstruct/mmf"
@@ -125,3 +129,482 @@ func TestCreateAndOpenMappedFile(t *testing.T) {
 		closeMF(mf, t)
 	}
 }
+
+func TestOpenMappedFileReadOnly(t *testing.T) {
+	defer os.Remove("test2.tmp")
+	if _, err := OpenMappedFileReadOnly("test2.tmp"); err == nil {
+		t.Fatal("expected an error when opening a missing file read-only")
+	}
+	{
+		mf, err := CreateMappedFile("test2.tmp", 4096)
+		if err != nil {
+			t.Fatal("Error while creating mapped file:", err)
+		}
+		copy(mf.Bytes()[100:], []byte("ABCDE"))
+		closeMF(mf, t)
+	}
+	mf, err := OpenMappedFileReadOnly("test2.tmp")
+	if err != nil {
+		t.Fatal("Error while opening mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	if !mf.ReadOnly() {
+		t.Error("expected the mapped file to be read-only")
+	}
+	var data [5]byte
+	if _, err := mf.ReadAt(data[:], 100); err != nil {
+		t.Fatal("Error while reading from mapped file:", err)
+	}
+	if string(data[:]) != "ABCDE" {
+		t.Error("expected ABCDE, got", data)
+	}
+	if _, err := mf.WriteAt(data[:], 0); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from WriteAt, got", err)
+	}
+	if _, err := mf.Write(data[:]); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from Write, got", err)
+	}
+	if err := mf.WriteByte(42); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from WriteByte, got", err)
+	}
+	if err := mf.Truncate(8192); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly from Truncate, got", err)
+	}
+	if err := mf.Sync(); err != nil {
+		t.Error("Error while syncing read-only mapped file:", err)
+	}
+}
+
+func TestOpenMappedFileWithOptions(t *testing.T) {
+	defer os.Remove("test3.tmp")
+	if _, err := OpenMappedFileWithOptions("test3.tmp", WithSize(4096)); err == nil {
+		t.Fatal("expected an error when opening a missing file")
+	}
+	{
+		mf, err := OpenMappedFileWithOptions("test3.tmp", Exclusive(), WithSize(4096), WithMode(0600))
+		if err != nil {
+			t.Fatal("Error while creating mapped file:", err)
+		}
+		if s := mf.Size(); s != 4096 {
+			t.Error("size mismatch. expected 4096, got", s)
+		}
+		copy(mf.Bytes()[100:], []byte("ABCDE"))
+		closeMF(mf, t)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat("test3.tmp")
+		if err != nil {
+			t.Fatal("Error while stat'ing mapped file:", err)
+		}
+		if m := fi.Mode().Perm(); m != 0600 {
+			t.Error("mode mismatch. expected 0600, got", m)
+		}
+	}
+	if _, err := OpenMappedFileWithOptions("test3.tmp", Exclusive(), WithSize(4096)); err == nil {
+		t.Fatal("expected an error when exclusively creating an existing file")
+	}
+	if _, err := OpenMappedFileWithOptions("test3.tmp", ReadOnly(), WithSize(8192)); err == nil {
+		t.Fatal("expected an error when resizing a read-only file")
+	}
+	{
+		mf, err := OpenMappedFileWithOptions("test3.tmp", MustExist(), WithSize(8192), Populate())
+		if err != nil {
+			t.Fatal("Error while opening mapped file:", err)
+		}
+		if s := mf.Size(); s != 8192 {
+			t.Error("size mismatch. expected 8192, got", s)
+		}
+		if string(mf.Bytes()[100:105]) != "ABCDE" {
+			t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+		}
+		closeMF(mf, t)
+	}
+	{
+		mf, err := OpenMappedFileWithOptions("test3.tmp", CreateIfMissing(), TruncateExisting(), WithSize(1024))
+		if err != nil {
+			t.Fatal("Error while opening mapped file:", err)
+		}
+		if s := mf.Size(); s != 1024 {
+			t.Error("size mismatch. expected 1024, got", s)
+		}
+		if mf.Bytes()[100] != 0 {
+			t.Error("expected the content to be discarded")
+		}
+		closeMF(mf, t)
+	}
+}
+
+func TestOpenMappedFileCopyOnWrite(t *testing.T) {
+	defer os.Remove("test4.tmp")
+	{
+		mf, err := CreateMappedFile("test4.tmp", 4096)
+		if err != nil {
+			t.Fatal("Error while creating mapped file:", err)
+		}
+		copy(mf.Bytes()[100:], []byte("ABCDE"))
+		closeMF(mf, t)
+	}
+	{
+		mf, err := OpenMappedFileCopyOnWrite("test4.tmp")
+		if err != nil {
+			t.Fatal("Error while opening mapped file:", err)
+		}
+		defer closeMF(mf, t)
+		if _, err := mf.WriteAt([]byte("XYZ"), 100); err != nil {
+			t.Fatal("Error while writing to mapped file:", err)
+		}
+		if err := mf.Truncate(8192); err != nil {
+			t.Fatal("Error while truncating mapped file:", err)
+		}
+		if s := mf.Size(); s != 8192 {
+			t.Error("size mismatch. expected 8192, got", s)
+		}
+		if string(mf.Bytes()[100:105]) != "XYZDE" {
+			t.Error("expected XYZDE, got", mf.Bytes()[100:105])
+		}
+		copy(mf.Bytes()[6000:], []byte("ABCDE"))
+		if err := mf.Sync(); err != nil {
+			t.Error("Error while syncing mapped file:", err)
+		}
+		closeMF(mf, t)
+	}
+	{
+		mf, err := OpenMappedFile("test4.tmp")
+		if err != nil {
+			t.Fatal("Error while opening mapped file:", err)
+		}
+		defer closeMF(mf, t)
+		if s := mf.Size(); s != 4096 {
+			t.Error("size mismatch. expected 4096, got", s)
+		}
+		if string(mf.Bytes()[100:105]) != "ABCDE" {
+			t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+		}
+		closeMF(mf, t)
+	}
+}
+
+func TestNewAnonymousMapping(t *testing.T) {
+	mf, err := NewAnonymousMapping(4096)
+	if err != nil {
+		t.Fatal("Error while creating anonymous mapping:", err)
+	}
+	defer closeMF(mf, t)
+	if s := mf.Size(); s != 4096 {
+		t.Error("size mismatch. expected 4096, got", s)
+	}
+	if n := mf.Name(); n != "" {
+		t.Error("name mismatch. got", n)
+	}
+	copy(mf.Bytes()[100:], []byte("ABCDE"))
+	if err := mf.Truncate(8192); err != nil {
+		t.Fatal("Error while truncating anonymous mapping:", err)
+	}
+	if s := mf.Size(); s != 8192 {
+		t.Error("size mismatch. expected 8192, got", s)
+	}
+	if string(mf.Bytes()[100:105]) != "ABCDE" {
+		t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+	}
+	if err := mf.Sync(); err != nil {
+		t.Error("Error while syncing anonymous mapping:", err)
+	}
+}
+
+func TestReserveAddressSpace(t *testing.T) {
+	defer os.Remove("test5.tmp")
+	mf, err := OpenMappedFileWithOptions("test5.tmp", CreateIfMissing(), WithSize(4096), ReserveAddressSpace(1<<20))
+	if err == ErrNotSupported {
+		t.Skip("reserving address space is not supported on this platform")
+	}
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	data := mf.Bytes()
+	copy(data[100:], []byte("ABCDE"))
+
+	if err := mf.Truncate(10000); err != nil {
+		t.Fatal("Error while truncating mapped file:", err)
+	}
+	if s := mf.Size(); s != 10000 {
+		t.Error("size mismatch. expected 10000, got", s)
+	}
+	if &mf.Bytes()[0] != &data[0] {
+		t.Error("the address of the mapped memory has changed")
+	}
+	// the old slice is still valid
+	copy(data[200:], []byte("XYZ"))
+	if string(mf.Bytes()[200:203]) != "XYZ" {
+		t.Error("expected XYZ, got", mf.Bytes()[200:203])
+	}
+	copy(mf.Bytes()[9000:], []byte("ABCDE"))
+
+	if err := mf.Truncate(2 << 20); err == nil {
+		t.Error("expected an error when growing beyond the reserved address space")
+	}
+	if err := mf.Truncate(1000); err != nil {
+		t.Fatal("Error while truncating mapped file:", err)
+	}
+	if err := mf.Truncate(1 << 20); err != nil {
+		t.Fatal("Error while truncating mapped file:", err)
+	}
+	if &mf.Bytes()[0] != &data[0] {
+		t.Error("the address of the mapped memory has changed")
+	}
+	if string(mf.Bytes()[100:105]) != "ABCDE" {
+		t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+	}
+	if mf.Bytes()[9000] != 0 {
+		t.Error("expected the truncated region to be zeroed")
+	}
+	if err := mf.Sync(); err != nil {
+		t.Error("Error while syncing mapped file:", err)
+	}
+}
+
+func TestAdvise(t *testing.T) {
+	defer os.Remove("test7.tmp")
+	mf, err := CreateMappedFile("test7.tmp", 3*4096)
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	copy(mf.Bytes()[100:], []byte("ABCDE"))
+	for _, advice := range []Advice{AdviceSequential, AdviceRandom, AdviceWillNeed, AdviceDontNeed, AdviceNormal} {
+		if err := mf.Advise(100, 5000, advice); err != nil {
+			t.Error("Error while advising", advice, err)
+		}
+	}
+	// the content of shared mappings is kept
+	if string(mf.Bytes()[100:105]) != "ABCDE" {
+		t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+	}
+	if err := mf.Advise(4096, 3*4096, AdviceNormal); err == nil {
+		t.Error("expected an error when advising out of bounds")
+	}
+}
+
+func TestLock(t *testing.T) {
+	defer os.Remove("test8.tmp")
+	mf, err := CreateMappedFile("test8.tmp", 3*4096)
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	err = mf.Lock(100, 5000)
+	if _, ok := err.(*MemlockLimitError); ok {
+		t.Skip("locking memory is not permitted:", err)
+	}
+	if err != nil {
+		t.Fatal("Error while locking mapped memory:", err)
+	}
+	if err := mf.Unlock(100, 5000); err != nil {
+		t.Error("Error while unlocking mapped memory:", err)
+	}
+	if err := mf.LockAll(); err != nil {
+		t.Error("Error while locking mapped memory:", err)
+	}
+	if err := mf.UnlockAll(); err != nil {
+		t.Error("Error while unlocking mapped memory:", err)
+	}
+	if err := mf.Lock(4096, 3*4096); err == nil {
+		t.Error("expected an error when locking out of bounds")
+	}
+}
+
+func TestSyncRange(t *testing.T) {
+	defer os.Remove("test9.tmp")
+	mf, err := CreateMappedFile("test9.tmp", 3*4096)
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	copy(mf.Bytes()[5000:], []byte("ABCDE"))
+	if err := mf.SyncRange(5000, 5, false); err != nil {
+		t.Error("Error while syncing range:", err)
+	}
+	if err := mf.SyncRange(100, 5000, true); err != nil {
+		t.Error("Error while syncing range asynchronously:", err)
+	}
+	if err := mf.SyncAsync(); err != nil {
+		t.Error("Error while syncing asynchronously:", err)
+	}
+	if err := mf.SyncRange(4096, 3*4096, false); err == nil {
+		t.Error("expected an error when syncing out of bounds")
+	}
+
+	f, err := os.Open("test9.tmp")
+	if err != nil {
+		t.Fatal("Error while opening file:", err)
+	}
+	defer f.Close()
+	var data [5]byte
+	if _, err := f.ReadAt(data[:], 5000); err != nil {
+		t.Fatal("Error while reading file:", err)
+	}
+	if string(data[:]) != "ABCDE" {
+		t.Error("expected ABCDE, got", data)
+	}
+}
+
+func TestSafeAccess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mapped files can't be truncated on windows")
+	}
+	defer os.Remove("test11.tmp")
+	mf, err := OpenMappedFileWithOptions("test11.tmp", CreateIfMissing(), WithSize(3*4096), SafeAccess())
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	if _, err := mf.WriteAt([]byte("ABCDE"), 100); err != nil {
+		t.Fatal("Error while writing to mapped file:", err)
+	}
+
+	// truncate the file behind the back of the mapping
+	if err := os.Truncate("test11.tmp", 4096); err != nil {
+		t.Fatal("Error while truncating file:", err)
+	}
+	var data [5]byte
+	if _, err := mf.ReadAt(data[:], 100); err != nil {
+		t.Error("Error while reading from mapped file:", err)
+	}
+	_, err = mf.ReadAt(data[:], 2*4096+100)
+	if !errors.Is(err, ErrMappingFault) {
+		t.Fatal("expected ErrMappingFault from ReadAt, got", err)
+	}
+	if fault, ok := err.(*MappingFaultError); !ok || fault.Offset != 2*4096+100 {
+		t.Error("expected a fault at offset", 2*4096+100, "got", err)
+	}
+	if _, err := mf.WriteAt(data[:], 2*4096); !errors.Is(err, ErrMappingFault) {
+		t.Error("expected ErrMappingFault from WriteAt, got", err)
+	}
+	err = mf.Map(4096, 4096, func(data []byte) error {
+		data[0] = 42
+		return nil
+	})
+	if !errors.Is(err, ErrMappingFault) {
+		t.Error("expected ErrMappingFault from Map, got", err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		// POSIX record locks don't exclude each other within a process
+		t.Skip("file locks are owned by the process on", runtime.GOOS)
+	}
+	defer os.Remove("test12.tmp")
+	mf, err := OpenMappedFileWithOptions("test12.tmp", CreateIfMissing(), WithSize(4096), WithFileLock())
+	if err != nil {
+		t.Fatal("Error while creating file:", err)
+	}
+	if _, err := OpenMappedFileWithOptions("test12.tmp", WithFileLockNoWait()); err != ErrFileLocked {
+		t.Error("expected ErrFileLocked, got", err)
+	}
+	if err := mf.UnlockFile(); err != nil {
+		t.Fatal("Error while unlocking file:", err)
+	}
+	if err := mf.RLockFile(); err != nil {
+		t.Fatal("Error while locking file:", err)
+	}
+	mf2, err := OpenMappedFileWithOptions("test12.tmp", ReadOnly(), WithFileLockNoWait())
+	if err != nil {
+		t.Fatal("Error while opening a shared locked file:", err)
+	}
+	if _, err := OpenMappedFileWithOptions("test12.tmp", WithFileLockNoWait()); err != ErrFileLocked {
+		t.Error("expected ErrFileLocked for a writer, got", err)
+	}
+	closeMF(mf2, t)
+	if err := mf.UnlockFile(); err != nil {
+		t.Fatal("Error while unlocking file:", err)
+	}
+
+	mf3, err := OpenMappedFile("test12.tmp")
+	if err != nil {
+		t.Fatal("Error while opening file:", err)
+	}
+	defer closeMF(mf3, t)
+	if err := mf.LockFileRange(0, 100, true); err != nil {
+		t.Fatal("Error while locking range:", err)
+	}
+	if ok, err := mf3.TryLockFileRange(50, 100, false); ok || err != nil {
+		t.Error("expected TryLockFileRange to fail on an overlapping range, got", ok, err)
+	}
+	if ok, err := mf3.TryLockFileRange(100, 100, true); !ok || err != nil {
+		t.Error("expected TryLockFileRange to succeed on a disjoint range, got", ok, err)
+	}
+	if err := mf.LockFileRange(-1, 100, true); err == nil {
+		t.Error("expected an error for an invalid range")
+	}
+	closeMF(mf, t)
+	if ok, err := mf3.TryLockFileRange(50, 100, false); !ok || err != nil {
+		t.Error("expected the locks to be released by Close, got", ok, err)
+	}
+
+	anon, err := NewAnonymousMapping(4096)
+	if err != nil {
+		t.Fatal("Error while creating anonymous mapping:", err)
+	}
+	defer closeMF(anon, t)
+	if err := anon.LockFile(); err == nil {
+		t.Error("expected an error when locking an anonymous mapping")
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	mf, err := NewAnonymousMapping(4096)
+	if err != nil {
+		t.Fatal("Error while creating anonymous mapping:", err)
+	}
+	defer closeMF(mf, t)
+	if _, err := mf.AtomicUint32At(2); err != ErrUnaligned {
+		t.Error("expected ErrUnaligned, got", err)
+	}
+	if _, err := mf.AddUint64(12, 1); err != ErrUnaligned {
+		t.Error("expected ErrUnaligned, got", err)
+	}
+	if _, err := mf.LoadUint32(4096); err == nil {
+		t.Error("expected an error for an offset out of bounds")
+	}
+	p, err := mf.AtomicUint32At(8)
+	if err != nil {
+		t.Fatal("Error while getting atomic pointer:", err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if _, err := mf.AddUint32(8, 1); err != nil {
+					t.Error("Error while adding:", err)
+					return
+				}
+				if _, err := mf.AddUint64(16, 2); err != nil {
+					t.Error("Error while adding:", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := atomic.LoadUint32(p); v != 8000 {
+		t.Error("unexpected value", v)
+	}
+	if v, err := mf.LoadUint64(16); err != nil || v != 16000 {
+		t.Error("unexpected value", v, err)
+	}
+	if ok, err := mf.CompareAndSwapUint64(16, 1, 2); ok || err != nil {
+		t.Error("expected CompareAndSwap to fail, got", ok, err)
+	}
+	if ok, err := mf.CompareAndSwapUint64(16, 16000, 2); !ok || err != nil {
+		t.Error("expected CompareAndSwap to succeed, got", ok, err)
+	}
+	if err := mf.StoreUint32(8, 42); err != nil {
+		t.Error("Error while storing:", err)
+	}
+	if v, err := mf.AddUint32(8, ^uint32(0)); err != nil || v != 41 {
+		t.Error("unexpected value", v, err)
+	}
+}
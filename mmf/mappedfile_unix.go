@@ -1,8 +1,9 @@
-// +build !windows
+// +build !windows,!js,!plan9,!wasip1
 
 package mmf
 
 import (
+	"fmt"
 	"os"
 	"unsafe"
 
@@ -11,14 +12,133 @@ import (
 
 // MappedFile is a struct that defines an open memory mapped file
 type MappedFile struct {
-	data []byte
-	off  int
-	file *os.File
+	data     []byte
+	off      int
+	file     *os.File
+	prot     Protection
+	private  bool
+	populate bool
+	reserve  int
+	reserved []byte
+
+	preallocate bool
+	safeAccess  bool
+}
+
+func (mf *MappedFile) mmapProt() int {
+	prot := syscall.PROT_READ
+	if mf.prot&ProtWrite != 0 {
+		prot |= syscall.PROT_WRITE
+	}
+	if mf.prot&ProtExec != 0 {
+		prot |= syscall.PROT_EXEC
+	}
+	return prot
+}
+
+func (mf *MappedFile) mmapFlags() int {
+	flags := syscall.MAP_SHARED
+	if mf.private {
+		flags = syscall.MAP_PRIVATE
+	}
+	if mf.populate {
+		flags |= mapPopulate
+	}
+	return flags
 }
 
 func (mf *MappedFile) mmap(size int) error {
+	if mf.reserve != 0 {
+		return mf.mmapReserved(size)
+	}
+	prot := mf.mmapProt()
+	flags := mf.mmapFlags()
 	var err error
-	mf.data, err = syscall.Mmap(int(mf.file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	mf.data, err = syscall.Mmap(int(mf.file.Fd()), 0, size, prot, flags)
+	if err != nil {
+		return os.NewSyscallError("Mmap", err)
+	}
+	return nil
+}
+
+// remapAnonymous moves the content of the mapped memory to a new anonymous
+// mapping of the given size.
+func (mf *MappedFile) remapAnonymous(size int) error {
+	data, err := syscall.Mmap(-1, 0, size, mf.mmapProt(), syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return os.NewSyscallError("Mmap", err)
+	}
+	copy(data, mf.data)
+	if err := mf.munmap(); err != nil {
+		syscall.Munmap(data)
+		return err
+	}
+	mf.data = data
+	return nil
+}
+
+func pageRoundUp(size int) int {
+	pagesize := os.Getpagesize()
+	return (size + pagesize - 1) / pagesize * pagesize
+}
+
+// mmapReserved reserves the address space with an inaccessible anonymous
+// mapping, and maps the file to the beginning of it.
+func (mf *MappedFile) mmapReserved(size int) error {
+	reserved, err := syscall.Mmap(-1, 0, mf.reserve, syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return os.NewSyscallError("Mmap", err)
+	}
+	mf.reserved = reserved
+	if n := pageRoundUp(size); n > 0 {
+		if err := mf.mmapFixed(0, n, int(mf.file.Fd()), mf.mmapProt(), mf.mmapFlags()); err != nil {
+			mf.reserved = nil
+			syscall.Munmap(reserved)
+			return err
+		}
+	}
+	mf.data = reserved[:size:size]
+	return nil
+}
+
+// resizeReserved changes the size of the file, and maps or unmaps the pages
+// at the end of the reserved address space, without moving the mapping.
+func (mf *MappedFile) resizeReserved(size int) error {
+	if size > len(mf.reserved) {
+		return fmt.Errorf("MappedFile: requested file size exceeds the reserved address space")
+	}
+	if !mf.private {
+		if err := growFile(mf.file, int64(len(mf.data)), int64(size), mf.preallocate); err != nil {
+			return err
+		}
+	}
+	old, n := pageRoundUp(len(mf.data)), pageRoundUp(size)
+	if n > old {
+		if mf.private {
+			// the region is beyond the end of the unmodified file
+			err := mf.mmapFixed(old, n-old, -1, mf.mmapProt(), syscall.MAP_PRIVATE|syscall.MAP_ANON)
+			if err != nil {
+				return err
+			}
+		} else if err := mf.mmapFixed(old, n-old, int(mf.file.Fd()), mf.mmapProt(), mf.mmapFlags()); err != nil {
+			return err
+		}
+	} else if n < old {
+		if err := mf.mmapFixed(n, old-n, -1, syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANON); err != nil {
+			return err
+		}
+	}
+	mf.data = mf.reserved[:size:size]
+	return nil
+}
+
+// mmapFixed maps the given region of the reserved address space.
+func (mf *MappedFile) mmapFixed(off, length int, fd int, prot int, flags int) error {
+	var fileOff int64
+	if fd != -1 {
+		fileOff = int64(off)
+	}
+	_, err := syscall.MmapPtr(fd, fileOff, unsafe.Pointer(&mf.reserved[off]), uintptr(length), prot, flags|syscall.MAP_FIXED)
 	if err != nil {
 		return os.NewSyscallError("Mmap", err)
 	}
@@ -26,6 +146,14 @@ func (mf *MappedFile) mmap(size int) error {
 }
 
 func (mf *MappedFile) munmap() error {
+	if reserved := mf.reserved; reserved != nil {
+		mf.reserved = nil
+		mf.data = nil
+		if err := syscall.Munmap(reserved); err != nil {
+			return os.NewSyscallError("Munmap", err)
+		}
+		return nil
+	}
 	if data := mf.data; data != nil {
 		mf.data = nil
 		if err := syscall.Munmap(data); err != nil {
@@ -35,16 +163,61 @@ func (mf *MappedFile) munmap() error {
 	return nil
 }
 
-func (mf *MappedFile) sync(async bool) error {
-	var flags uintptr
+func (mf *MappedFile) sync(b []byte, async bool) error {
+	flags := syscall.MS_SYNC
 	if async {
 		flags = syscall.MS_ASYNC
-	} else {
-		flags = syscall.MS_SYNC
 	}
-	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mf.data[0])), uintptr(len(mf.data)), flags)
-	if errno != 0 {
-		return os.NewSyscallError("Msync", errno)
+	if err := syscall.Msync(b, flags); err != nil {
+		return os.NewSyscallError("Msync", err)
+	}
+	return nil
+}
+
+func (mf *MappedFile) madvise(b []byte, advice Advice) error {
+	var flag int
+	switch advice {
+	case AdviceNormal:
+		flag = syscall.MADV_NORMAL
+	case AdviceRandom:
+		flag = syscall.MADV_RANDOM
+	case AdviceSequential:
+		flag = syscall.MADV_SEQUENTIAL
+	case AdviceWillNeed:
+		flag = syscall.MADV_WILLNEED
+	case AdviceDontNeed:
+		flag = syscall.MADV_DONTNEED
+	case AdviceHugePage:
+		flag = madvHugePage
+	case AdviceNoHugePage:
+		flag = madvNoHugePage
+	case AdviceFree:
+		flag = madvFree
+	default:
+		return fmt.Errorf("MappedFile: unknown advice %d", advice)
+	}
+	if flag == -1 {
+		return ErrNotSupported
+	}
+	if err := syscall.Madvise(b, flag); err != nil {
+		return os.NewSyscallError("Madvise", err)
+	}
+	return nil
+}
+
+func (mf *MappedFile) mlock(b []byte) error {
+	if err := syscall.Mlock(b); err != nil {
+		if err == syscall.ENOMEM || err == syscall.EPERM {
+			return &MemlockLimitError{Length: len(b), Limit: memlockLimit(), Err: os.NewSyscallError("Mlock", err)}
+		}
+		return os.NewSyscallError("Mlock", err)
+	}
+	return nil
+}
+
+func (mf *MappedFile) munlock(b []byte) error {
+	if err := syscall.Munlock(b); err != nil {
+		return os.NewSyscallError("Munlock", err)
 	}
 	return nil
 }
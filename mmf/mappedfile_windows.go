@@ -1,32 +1,94 @@
 package mmf
 
 import (
+	"fmt"
 	"os"
 	"unsafe"
 
 	syscall "golang.org/x/sys/windows"
 )
 
+var (
+	modkernel32               = syscall.NewLazySystemDLL("kernel32.dll")
+	procPrefetchVirtualMemory = modkernel32.NewProc("PrefetchVirtualMemory")
+	procDiscardVirtualMemory  = modkernel32.NewProc("DiscardVirtualMemory")
+)
+
 // MappedFile is a struct that defines an open memory mapped file
 type MappedFile struct {
-	data   []byte
-	off    int
-	file   *os.File
-	handle syscall.Handle
+	data     []byte
+	off      int
+	file     *os.File
+	handle   syscall.Handle
+	prot     Protection
+	private  bool
+	populate bool // not supported
+	reserve  int  // not supported
+
+	preallocate bool
+	safeAccess  bool
 }
 
 func (mf *MappedFile) mmap(size int) error {
-	handle, err := syscall.CreateFileMapping(syscall.Handle(mf.file.Fd()), nil, syscall.PAGE_READWRITE, 0, 0, nil) // 0,0 := total size of the file
+	if mf.reserve != 0 {
+		return ErrNotSupported
+	}
+	var prot, access uint32
+	exec := mf.prot&ProtExec != 0
+	switch {
+	case mf.prot&ProtWrite == 0 && exec:
+		prot, access = syscall.PAGE_EXECUTE_READ, syscall.FILE_MAP_READ|syscall.FILE_MAP_EXECUTE
+	case mf.prot&ProtWrite == 0:
+		prot, access = syscall.PAGE_READONLY, syscall.FILE_MAP_READ
+	case mf.private && exec:
+		prot, access = syscall.PAGE_EXECUTE_WRITECOPY, syscall.FILE_MAP_COPY|syscall.FILE_MAP_EXECUTE
+	case mf.private:
+		prot, access = syscall.PAGE_WRITECOPY, syscall.FILE_MAP_COPY
+	case exec:
+		prot, access = syscall.PAGE_EXECUTE_READWRITE, syscall.FILE_MAP_WRITE|syscall.FILE_MAP_EXECUTE
+	default:
+		prot, access = syscall.PAGE_READWRITE, syscall.FILE_MAP_WRITE
+	}
+	handle, err := syscall.CreateFileMapping(syscall.Handle(mf.file.Fd()), nil, prot, 0, 0, nil) // 0,0 := total size of the file
+	if err != nil {
+		return os.NewSyscallError("CreateFileMapping", err)
+	}
+	ptr, err := syscall.MapViewOfFile(handle, access, 0, 0, uintptr(size))
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return os.NewSyscallError("MapViewOfFile", err)
+	}
+	mf.handle = handle
+	mf.data = unsafe.Slice((*byte)(unsafe.Pointer(ptr)), size)
+	return nil
+}
+
+// remapAnonymous moves the content of the mapped memory to a new anonymous
+// mapping (backed by the paging file) of the given size.
+func (mf *MappedFile) remapAnonymous(size int) error {
+	var prot uint32 = syscall.PAGE_READWRITE
+	var access uint32 = syscall.FILE_MAP_WRITE
+	if mf.prot&ProtExec != 0 {
+		prot, access = syscall.PAGE_EXECUTE_READWRITE, syscall.FILE_MAP_WRITE|syscall.FILE_MAP_EXECUTE
+	}
+	handle, err := syscall.CreateFileMapping(syscall.InvalidHandle, nil, prot, uint32(uint64(size)>>32), uint32(size), nil)
 	if err != nil {
 		return os.NewSyscallError("CreateFileMapping", err)
 	}
-	ptr, err := syscall.MapViewOfFile(handle, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	ptr, err := syscall.MapViewOfFile(handle, access, 0, 0, uintptr(size))
 	if err != nil {
 		syscall.CloseHandle(handle)
 		return os.NewSyscallError("MapViewOfFile", err)
 	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(ptr)), size)
+	copy(data, mf.data)
+	if err := mf.munmap(); err != nil {
+		syscall.UnmapViewOfFile(ptr)
+		syscall.CloseHandle(handle)
+		return err
+	}
 	mf.handle = handle
-	mf.data = (*[1<<31 - 1]byte)(unsafe.Pointer(ptr))[:size]
+	mf.data = data
 	return nil
 }
 
@@ -46,15 +108,80 @@ func (mf *MappedFile) munmap() error {
 	return nil
 }
 
-func (mf *MappedFile) sync(async bool) error {
-	err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&mf.data[0])), uintptr(len(mf.data)))
+func (mf *MappedFile) sync(b []byte, async bool) error {
+	err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
 	if err != nil {
 		return os.NewSyscallError("FlushViewOfFile", err)
 	}
 	if !async {
-		if err := syscall.FlushFileBuffers(mf.handle); err != nil {
+		if err := syscall.FlushFileBuffers(syscall.Handle(mf.file.Fd())); err != nil {
 			return os.NewSyscallError("FlushFileBuffers", err)
 		}
 	}
 	return nil
 }
+
+func (mf *MappedFile) resizeReserved(size int) error {
+	return ErrNotSupported
+}
+
+// memoryRangeEntry is the WIN32_MEMORY_RANGE_ENTRY struct
+type memoryRangeEntry struct {
+	virtualAddress uintptr
+	numberOfBytes  uintptr
+}
+
+func (mf *MappedFile) madvise(b []byte, advice Advice) error {
+	switch advice {
+	case AdviceNormal, AdviceRandom, AdviceSequential:
+		// there is no equivalent
+		return nil
+	case AdviceWillNeed:
+		if procPrefetchVirtualMemory.Find() != nil {
+			return ErrNotSupported
+		}
+		entry := memoryRangeEntry{uintptr(unsafe.Pointer(&b[0])), uintptr(len(b))}
+		r1, _, e1 := procPrefetchVirtualMemory.Call(uintptr(syscall.CurrentProcess()), 1, uintptr(unsafe.Pointer(&entry)), 0)
+		if r1 == 0 {
+			return os.NewSyscallError("PrefetchVirtualMemory", e1)
+		}
+		return nil
+	case AdviceDontNeed:
+		if !mf.private {
+			// the content of shared views must be kept
+			return nil
+		}
+		if procDiscardVirtualMemory.Find() != nil {
+			return ErrNotSupported
+		}
+		r1, _, _ := procDiscardVirtualMemory.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+		if r1 != 0 {
+			return os.NewSyscallError("DiscardVirtualMemory", syscall.Errno(r1))
+		}
+		return nil
+	case AdviceHugePage, AdviceNoHugePage, AdviceFree:
+		return ErrNotSupported
+	default:
+		return fmt.Errorf("MappedFile: unknown advice %d", advice)
+	}
+}
+
+func (mf *MappedFile) mlock(b []byte) error {
+	if err := syscall.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b))); err != nil {
+		if err == syscall.ERROR_WORKING_SET_QUOTA {
+			var min, max uintptr
+			var flags uint32
+			syscall.GetProcessWorkingSetSizeEx(syscall.CurrentProcess(), &min, &max, &flags)
+			return &MemlockLimitError{Length: len(b), Limit: uint64(min), Err: os.NewSyscallError("VirtualLock", err)}
+		}
+		return os.NewSyscallError("VirtualLock", err)
+	}
+	return nil
+}
+
+func (mf *MappedFile) munlock(b []byte) error {
+	if err := syscall.VirtualUnlock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b))); err != nil {
+		return os.NewSyscallError("VirtualUnlock", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package mmf
+
+import (
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+// NewMemfdMapping creates an anonymous file in memory (using memfd_create)
+// with the given size, and maps it to memory. The name is only used for
+// debugging purposes. Unlike NewAnonymousMapping, the mapping is backed by a
+// file descriptor (see Fd), so Truncate resizes the file in place, and the
+// descriptor can be passed to child processes (for example with
+// exec.Cmd.ExtraFiles) which can map the same memory with
+// OpenMappedFileFromFile.
+// It returns an error, if any.
+func NewMemfdMapping(name string, size int64) (*MappedFile, error) {
+	fd, err := syscall.MemfdCreate(name, syscall.MFD_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("MemfdCreate", err)
+	}
+	f := os.NewFile(uintptr(fd), "memfd:"+name)
+	mf, err := OpenMappedFileFromFile(f, WithSize(size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mf, nil
+}
@@ -0,0 +1,45 @@
+package mmf_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func TestNewMemfdMapping(t *testing.T) {
+	mf, err := NewMemfdMapping("mmf-test", 4096)
+	if err != nil {
+		t.Fatal("Error while creating memfd mapping:", err)
+	}
+	defer closeMF(mf, t)
+	copy(mf.Bytes()[100:], []byte("ABCDE"))
+	if err := mf.Truncate(8192); err != nil {
+		t.Fatal("Error while truncating memfd mapping:", err)
+	}
+	if s := mf.Size(); s != 8192 {
+		t.Error("size mismatch. expected 8192, got", s)
+	}
+
+	// map the same memory through a second descriptor, like a child process would do
+	fd, err := syscall.Dup(int(mf.Fd()))
+	if err != nil {
+		t.Fatal("Error while duplicating file descriptor:", err)
+	}
+	mf2, err := OpenMappedFileFromFile(os.NewFile(uintptr(fd), "memfd"))
+	if err != nil {
+		t.Fatal("Error while mapping memfd:", err)
+	}
+	defer closeMF(mf2, t)
+	if s := mf2.Size(); s != 8192 {
+		t.Error("size mismatch. expected 8192, got", s)
+	}
+	if string(mf2.Bytes()[100:105]) != "ABCDE" {
+		t.Error("expected ABCDE, got", mf2.Bytes()[100:105])
+	}
+	copy(mf2.Bytes()[6000:], []byte("XYZ"))
+	if string(mf.Bytes()[6000:6003]) != "XYZ" {
+		t.Error("expected XYZ, got", mf.Bytes()[6000:6003])
+	}
+}
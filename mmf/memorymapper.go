@@ -0,0 +1,100 @@
+package mmf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MemoryMapper is a Mapper that is backed by a plain byte slice. It can be
+// used on platforms without support for memory mapped files, and for tests
+// or temporary data structures that should not hit the disk.
+type MemoryMapper struct {
+	data []byte
+}
+
+// NewMemoryMapper creates a new MemoryMapper with the given size. The memory
+// is initialized with zeros.
+func NewMemoryMapper(size int) *MemoryMapper {
+	return &MemoryMapper{data: make([]byte, size)}
+}
+
+// NewMemoryMapperFromBytes creates a new MemoryMapper that uses the given
+// slice as memory. The slice must not be used after this call.
+func NewMemoryMapperFromBytes(data []byte) *MemoryMapper {
+	return &MemoryMapper{data: data}
+}
+
+// Size returns the total size of the memory.
+// mm.Size() == len(mm.Bytes()).
+func (mm *MemoryMapper) Size() int {
+	return len(mm.data)
+}
+
+// Bytes returns a slice to the memory.
+// The slice is valid only until mm.Truncate or mm.ReadFrom is called.
+func (mm *MemoryMapper) Bytes() []byte {
+	return mm.data
+}
+
+// Truncate changes the size of the memory. Growing the memory initializes the
+// new region with zeros. Slices returned by Bytes or passed to a Map handler
+// are not valid anymore.
+// It returns an error, if any.
+func (mm *MemoryMapper) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("MemoryMapper: requested size is negative")
+	}
+	if size != int64(int(size)) {
+		return fmt.Errorf("MemoryMapper: requested size is too large")
+	}
+	n := int(size)
+	if n <= cap(mm.data) {
+		old := len(mm.data)
+		mm.data = mm.data[:n]
+		for i := old; i < n; i++ {
+			mm.data[i] = 0
+		}
+		return nil
+	}
+	data := make([]byte, n)
+	copy(data, mm.data)
+	mm.data = data
+	return nil
+}
+
+// Map calls the given handler with a slice at the given range.
+func (mm *MemoryMapper) Map(off int64, length int, handler func([]byte) error) error {
+	if off < 0 || length < 0 || int64(len(mm.data)) < off+int64(length) {
+		return fmt.Errorf("MemoryMapper: invalid Map offset %d", off)
+	}
+	return handler(mm.data[int(off) : int(off)+length])
+}
+
+// WriteTo writes a snapshot of the whole memory to w.
+// It returns the number of bytes written and an error, if any.
+func (mm *MemoryMapper) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(mm.data)
+	if err == nil && n < len(mm.data) {
+		err = io.ErrShortWrite
+	}
+	return int64(n), err
+}
+
+// ReadFrom replaces the memory with the data read from r until EOF. The size
+// of the memory is changed to the number of bytes read. On error, the memory
+// is left unchanged.
+// It returns the number of bytes read and an error, if any.
+func (mm *MemoryMapper) ReadFrom(r io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	if n != int64(int(n)) {
+		return n, errors.New("MemoryMapper: data is too large")
+	}
+	mm.data = buf.Bytes()
+	return n, nil
+}
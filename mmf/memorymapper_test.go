@@ -0,0 +1,55 @@
+package mmf_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func TestMemoryMapper(t *testing.T) {
+	mm := NewMemoryMapper(4096)
+	if s := mm.Size(); s != 4096 {
+		t.Error("size mismatch. expected 4096, got", s)
+	}
+	err := mm.Map(100, 5, func(data []byte) error {
+		copy(data, []byte("ABCDE"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping memory:", err)
+	}
+	if err := mm.Map(4095, 2, func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error when mapping out of bounds")
+	}
+	if err := mm.Map(-1, 1, func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error when mapping a negative offset")
+	}
+
+	// shrink and grow again: the new region must be zeroed
+	if err := mm.Truncate(102); err != nil {
+		t.Fatal("Error while truncating memory:", err)
+	}
+	if err := mm.Truncate(8192); err != nil {
+		t.Fatal("Error while truncating memory:", err)
+	}
+	if s := mm.Size(); s != 8192 {
+		t.Error("size mismatch. expected 8192, got", s)
+	}
+	if !bytes.Equal(mm.Bytes()[100:105], []byte{'A', 'B', 0, 0, 0}) {
+		t.Error("expected AB000, got", mm.Bytes()[100:105])
+	}
+
+	// snapshot and load
+	var buf bytes.Buffer
+	if n, err := mm.WriteTo(&buf); err != nil || n != 8192 {
+		t.Fatal("Error while writing snapshot:", n, err)
+	}
+	mm2 := NewMemoryMapper(0)
+	if n, err := mm2.ReadFrom(&buf); err != nil || n != 8192 {
+		t.Fatal("Error while loading snapshot:", n, err)
+	}
+	if !bytes.Equal(mm.Bytes(), mm2.Bytes()) {
+		t.Error("snapshot mismatch")
+	}
+}
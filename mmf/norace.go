@@ -0,0 +1,12 @@
+//go:build !race
+// +build !race
+
+package mmf
+
+import "unsafe"
+
+// Without the race detector, the annotations (see race.go) are no-ops.
+
+func raceAcquire(addr unsafe.Pointer) {}
+
+func raceReleaseMerge(addr unsafe.Pointer) {}
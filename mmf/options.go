@@ -0,0 +1,290 @@
+package mmf
+
+import (
+	"fmt"
+	"os"
+)
+
+// Protection describes the kind of access to the mapped memory.
+type Protection int
+
+const (
+	ProtRead  Protection = 1 << iota // the mapped memory can be read
+	ProtWrite                        // the mapped memory can be written
+	ProtExec                         // the mapped memory can be executed
+)
+
+// Option is a functional option for OpenMappedFileWithOptions and
+// OpenWindowedMappedFile. The options for block-files (like
+// LargeBlockIndices) are used by CreateBlockFileWithOptions and
+// CreateBlockFileInMapperWithOptions.
+type Option func(*options)
+
+type options struct {
+	mode     os.FileMode
+	flag     int
+	size     int64
+	prot     Protection
+	private  bool
+	populate bool
+	reserve  int64
+
+	preallocate bool
+	safeAccess  bool
+	fileLock    fileLockMode
+
+	incompatFeatures uint32 // of a new block-file
+	wal              bool   // attach a write-ahead log to the block-file
+}
+
+type fileLockMode int
+
+const (
+	noFileLock fileLockMode = iota
+	fileLockWait
+	fileLockNoWait
+)
+
+func defaultOptions() options {
+	return options{
+		mode: defaultMode,
+		size: -1,
+		prot: ProtRead | ProtWrite,
+	}
+}
+
+func (o *options) validate() error {
+	if o.prot&ProtRead == 0 {
+		return fmt.Errorf("MappedFile: mapped memory must be readable")
+	}
+	if o.size != -1 {
+		if o.size < 0 {
+			return fmt.Errorf("MappedFile: requested file size is negative")
+		}
+	}
+	if o.reserve != 0 {
+		if o.reserve < 0 {
+			return fmt.Errorf("MappedFile: reserved address space is negative")
+		}
+		if o.reserve != int64(int(o.reserve)) {
+			return fmt.Errorf("MappedFile: reserved address space is too large")
+		}
+		if o.size > o.reserve {
+			return fmt.Errorf("MappedFile: requested file size exceeds the reserved address space")
+		}
+	}
+	return nil
+}
+
+// openFile opens the file with the flags that are required for the options.
+func (o *options) openFile(filename string) (*os.File, error) {
+	flags := rwFlags
+	modifiesFile := o.size != -1 || o.flag&(os.O_CREATE|os.O_TRUNC) != 0
+	if o.prot&ProtWrite == 0 {
+		if modifiesFile {
+			return nil, fmt.Errorf("MappedFile: unable to create or resize a read-only file")
+		}
+		flags = readOnlyFlags
+	} else if o.private && !modifiesFile {
+		// changes of private mappings never reach the file
+		flags = readOnlyFlags
+	}
+	if o.fileLock == noFileLock {
+		return os.OpenFile(filename, flags|o.flag, o.mode)
+	}
+	// the file is truncated after the lock was acquired
+	f, err := os.OpenFile(filename, flags|o.flag&^os.O_TRUNC, o.mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.lockFile(f, flags != readOnlyFlags); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if o.flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// lockFile acquires the lock on the file, that was requested by
+// WithFileLock or WithFileLockNoWait.
+func (o *options) lockFile(f *os.File, exclusive bool) error {
+	if o.fileLock == noFileLock {
+		return nil
+	}
+	ok, err := lockFile(f, exclusive, o.fileLock == fileLockWait)
+	if err == nil && !ok {
+		err = ErrFileLocked
+	}
+	return err
+}
+
+// WithMode sets the permissions that are used, when the file is created.
+// The default is 0666 (before umask).
+func WithMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// CreateIfMissing creates the file, when it does not exist.
+func CreateIfMissing() Option {
+	return func(o *options) {
+		o.flag |= os.O_CREATE
+	}
+}
+
+// MustExist lets the open fail, when the file does not exist. This is the
+// default for OpenMappedFileWithOptions.
+func MustExist() Option {
+	return func(o *options) {
+		o.flag &^= os.O_CREATE | os.O_EXCL
+	}
+}
+
+// Exclusive creates the file and lets the open fail, when the file already
+// exists.
+func Exclusive() Option {
+	return func(o *options) {
+		o.flag |= os.O_CREATE | os.O_EXCL
+	}
+}
+
+// TruncateExisting discards the content of the file, when it already exists.
+func TruncateExisting() Option {
+	return func(o *options) {
+		o.flag |= os.O_TRUNC
+	}
+}
+
+// WithSize changes the size of the file to the given size after it was
+// opened. Without this option, the current size of the file is mapped.
+func WithSize(size int64) Option {
+	return func(o *options) {
+		o.size = size
+	}
+}
+
+// WithProtection sets the kind of access to the mapped memory. The default is
+// ProtRead|ProtWrite. Without ProtWrite, the file is opened for reading only
+// (see ReadOnly).
+func WithProtection(prot Protection) Option {
+	return func(o *options) {
+		o.prot = prot
+	}
+}
+
+// ReadOnly opens the file for reading only, and maps it with ProtRead (see
+// OpenMappedFileReadOnly).
+func ReadOnly() Option {
+	return WithProtection(ProtRead)
+}
+
+// Shared maps the file so that changes are written back to the file and are
+// visible to other processes that map the same file. This is the default.
+func Shared() Option {
+	return func(o *options) {
+		o.private = false
+	}
+}
+
+// Private creates a private copy-on-write mapping. Changes to the mapped
+// memory are not visible to other processes, and are not written back to
+// the file (see OpenMappedFileCopyOnWrite). Unless the file is created or
+// resized by other options, it is opened for reading only.
+func Private() Option {
+	return func(o *options) {
+		o.private = true
+	}
+}
+
+// Populate is a hint to read the whole file into memory when it is mapped,
+// so that later accesses don't cause page faults. It is only supported on
+// Linux (MAP_POPULATE) and ignored on other platforms.
+func Populate() Option {
+	return func(o *options) {
+		o.populate = true
+	}
+}
+
+// ReserveAddressSpace reserves a range of virtual address space with the given
+// maximum size up front, in which the file is mapped. Truncate then keeps the
+// address of the mapped memory stable, so slices that were returned by Bytes
+// or passed to a Map handler remain valid, as long as they are still in the
+// bounds of the file. The file can't grow beyond the reserved size.
+// Reserving address space does not consume memory. It is not supported on
+// Windows.
+func ReserveAddressSpace(max int64) Option {
+	return func(o *options) {
+		o.reserve = max
+	}
+}
+
+// Preallocate reserves the disk space, whenever the file grows (when it is
+// created or resized with WithSize, or grows by Truncate). Without this
+// option, growing creates a sparse file, and running out of disk space causes
+// a fault (SIGBUS) on a later write to the mapped memory. With this option,
+// it is reported as an error by Truncate instead. It uses fallocate on
+// Linux, F_PREALLOCATE on darwin, SetFileInformationByHandle on Windows, and
+// falls back to writing zeros.
+func Preallocate() Option {
+	return func(o *options) {
+		o.preallocate = true
+	}
+}
+
+// SafeAccess turns faults while accessing the mapped memory in Map, ReadAt,
+// WriteAt, Read and Write into a returned *MappingFaultError (see
+// ErrMappingFault), instead of crashing the whole program. Faults happen for
+// example (with SIGBUS), when the file was truncated by an other process, or
+// when the disk is full. Accesses through the slice returned by Bytes are not
+// protected.
+func SafeAccess() Option {
+	return func(o *options) {
+		o.safeAccess = true
+	}
+}
+
+// WithFileLock acquires an advisory lock on the whole file, when it is opened
+// (see MappedFile.LockFile). The lock is exclusive, when the file is opened
+// for writing, and shared otherwise, so there can be a single writer or many
+// readers. It waits until the lock is available. The lock is released by
+// Close.
+func WithFileLock() Option {
+	return func(o *options) {
+		o.fileLock = fileLockWait
+	}
+}
+
+// WithFileLockNoWait is like WithFileLock, but it lets the open fail with
+// ErrFileLocked, when the lock is held by someone else.
+func WithFileLockNoWait() Option {
+	return func(o *options) {
+		o.fileLock = fileLockNoWait
+	}
+}
+
+// LargeBlockIndices creates a block-file with 64-bit block indices (see
+// IncompatLargeIndex), so it can have more than 2^32 blocks. The header of
+// the header block is 8 bytes larger, so the data section (see
+// BlockFile.MapHeader) is 8 bytes smaller. Such a file can't be opened by
+// older versions of this package.
+func LargeBlockIndices() Option {
+	return func(o *options) {
+		o.incompatFeatures |= IncompatLargeIndex
+	}
+}
+
+// WithChecksums creates a block-file with a CRC32C checksum at the end of
+// each block (see IncompatChecksums and BlockFile.SealBlock). The slices,
+// that are passed to the handlers of BlockFile.MapBlock and
+// BlockFile.MapHeader, are 4 bytes smaller.
+func WithChecksums() Option {
+	return func(o *options) {
+		o.incompatFeatures |= IncompatChecksums
+	}
+}
@@ -0,0 +1,40 @@
+package mmf
+
+import (
+	"os"
+)
+
+// preallocateByWriting reserves disk space for the given range of the file by
+// writing zeros to it. It is the fallback on platforms (and filesystems)
+// without support for preallocation. The range must be beyond the end of the
+// file.
+func preallocateByWriting(f *os.File, off int64, length int64) error {
+	zeros := make([]byte, 64<<10)
+	for length > 0 {
+		chunk := zeros
+		if length < int64(len(chunk)) {
+			chunk = chunk[:length]
+		}
+		n, err := f.WriteAt(chunk, off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+		length -= int64(n)
+	}
+	return nil
+}
+
+// growFile changes the size of the file to the given size. When prealloc is
+// true and the file grows, the disk space for the new region is reserved
+// first, so that running out of disk space is reported as an error instead of
+// a fault on a later access of the mapped memory.
+func growFile(f *os.File, oldSize int64, size int64, prealloc bool) error {
+	if prealloc && size > oldSize {
+		if err := preallocate(f, oldSize, size-oldSize); err != nil {
+			f.Truncate(oldSize)
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
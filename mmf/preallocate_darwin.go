@@ -0,0 +1,27 @@
+package mmf
+
+import (
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func preallocate(f *os.File, off int64, length int64) error {
+	// try to allocate contiguous space first
+	fstore := syscall.Fstore_t{
+		Flags:   syscall.F_ALLOCATECONTIG | syscall.F_ALLOCATEALL,
+		Posmode: syscall.F_PEOFPOSMODE,
+		Length:  length,
+	}
+	err := syscall.FcntlFstore(f.Fd(), syscall.F_PREALLOCATE, &fstore)
+	if err != nil {
+		fstore.Flags = syscall.F_ALLOCATEALL
+		err = syscall.FcntlFstore(f.Fd(), syscall.F_PREALLOCATE, &fstore)
+	}
+	if err == syscall.ENOTSUP {
+		return preallocateByWriting(f, off, length)
+	} else if err != nil {
+		return os.NewSyscallError("FcntlFstore", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package mmf
+
+import (
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func preallocate(f *os.File, off int64, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, off, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return preallocateByWriting(f, off, length)
+	} else if err != nil {
+		return os.NewSyscallError("Fallocate", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package mmf_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+// allocatedSize returns the number of bytes that are allocated on disk.
+func allocatedSize(filename string, t *testing.T) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal("Error while stat'ing file:", err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestPreallocate(t *testing.T) {
+	defer os.Remove("test10.tmp")
+	mf, err := OpenMappedFileWithOptions("test10.tmp", CreateIfMissing(), WithSize(1<<20), Preallocate())
+	if err != nil {
+		t.Fatal("Error while creating mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	if s := allocatedSize("test10.tmp", t); s < 1<<20 {
+		t.Error("expected at least 1MiB to be allocated, got", s)
+	}
+	copy(mf.Bytes()[100:], []byte("ABCDE"))
+	if err := mf.Truncate(2 << 20); err != nil {
+		t.Fatal("Error while truncating mapped file:", err)
+	}
+	if s := mf.Size(); s != 2<<20 {
+		t.Error("size mismatch. expected 2MiB, got", s)
+	}
+	if s := allocatedSize("test10.tmp", t); s < 2<<20 {
+		t.Error("expected at least 2MiB to be allocated, got", s)
+	}
+	if string(mf.Bytes()[100:105]) != "ABCDE" {
+		t.Error("expected ABCDE, got", mf.Bytes()[100:105])
+	}
+}
+
+func TestPreallocateBlockFile(t *testing.T) {
+	defer os.Remove("bftest8.tmp")
+	bf, err := CreateBlockFileWithOptions("bftest8.tmp", 4096, Preallocate())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	if _, err := bf.AllocateBlocks(16); err != nil {
+		t.Fatal("Error while allocating blocks", err)
+	}
+	if s := allocatedSize("bftest8.tmp", t); s < 17*4096 {
+		t.Error("expected at least 17 blocks to be allocated, got", s)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package mmf
+
+import (
+	"os"
+)
+
+func preallocate(f *os.File, off int64, length int64) error {
+	return preallocateByWriting(f, off, length)
+}
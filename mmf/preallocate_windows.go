@@ -0,0 +1,22 @@
+package mmf
+
+import (
+	"os"
+	"unsafe"
+
+	syscall "golang.org/x/sys/windows"
+)
+
+// fileAllocationInfo is the FILE_ALLOCATION_INFO struct
+type fileAllocationInfo struct {
+	allocationSize int64
+}
+
+func preallocate(f *os.File, off int64, length int64) error {
+	info := fileAllocationInfo{allocationSize: off + length}
+	err := syscall.SetFileInformationByHandle(syscall.Handle(f.Fd()), syscall.FileAllocationInfo, (*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		return os.NewSyscallError("SetFileInformationByHandle", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build js || plan9 || wasip1
+// +build js plan9 wasip1
+
+package mmf
+
+// processAlive can't check other processes on this platform, so it assumes
+// that they are alive.
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !js && !plan9 && !wasip1
+// +build !windows,!js,!plan9,!wasip1
+
+package mmf
+
+import (
+	syscall "golang.org/x/sys/unix"
+)
+
+// processAlive returns false, if there is no process with the given PID.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
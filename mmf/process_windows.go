@@ -0,0 +1,23 @@
+package mmf
+
+import (
+	syscall "golang.org/x/sys/windows"
+)
+
+const stillActive = 259 // STILL_ACTIVE
+
+// processAlive returns false, if there is no running process with the given
+// PID.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// access denied means, that the process exists
+		return err != syscall.ERROR_INVALID_PARAMETER
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
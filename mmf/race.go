@@ -0,0 +1,21 @@
+//go:build race
+// +build race
+
+package mmf
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// The race detector does not track atomic operations on memory, that was not
+// allocated by Go (like mapped memory). So the ordering, that is established
+// by them, is annotated on the given address in Go memory.
+
+func raceAcquire(addr unsafe.Pointer) {
+	runtime.RaceAcquire(addr)
+}
+
+func raceReleaseMerge(addr unsafe.Pointer) {
+	runtime.RaceReleaseMerge(addr)
+}
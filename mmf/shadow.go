@@ -0,0 +1,731 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// ErrNoShadowPaging is returned by Begin, when the block-file was not created
+// with the WithShadowPaging option.
+var ErrNoShadowPaging = errors.New("BlockFile: the block-file was not created with shadow paging")
+
+// ErrShadowPaging is returned by the methods of a BlockFile, that allocate,
+// free or change blocks (like AllocateBlock, FreeBlock and MapBlock), when the
+// block-file was created with the WithShadowPaging option. The blocks of such
+// a block-file are managed by the transactions (see Begin).
+var ErrShadowPaging = errors.New("BlockFile: the blocks of a block-file with shadow paging can only be used by transactions")
+
+// ErrTxNotWritable is returned, when a read-only transaction is used for
+// writing.
+var ErrTxNotWritable = errors.New("BlockFile: the transaction is read-only")
+
+// With IncompatShadowPaging, the blocks, that are used by transactions (see
+// Begin), are addressed by logical block-indices. A page table, which is a
+// radix tree of blocks with 64-bit entries, maps them to the physical blocks.
+// An entry of the lowest level is 0, when the logical block was never
+// allocated, the physical block-index, or shadowFreeBit and the next logical
+// block-index in the free-list of logical blocks.
+//
+// Transactions never change a block, that is reachable from the committed page
+// table. Instead, the block and the path to it in the page table are copied
+// to fresh blocks (shadow pages). The root of the page table is stored in two
+// meta slots in the header block, after the extended header:
+//
+//	0  txid        uint64 // the ID of the transaction, that wrote the slot
+//	8  root        uint64 // the physical block-index of the root of the page table
+//	16 next        uint64 // the next logical block-index, that was never handed out
+//	24 free        uint64 // the first logical block-index in the free-list
+//	32 highWater   uint64 // the number of physical blocks, that are in use or free
+//	40 freeRoot    uint64 // the physical block-index of the root of the physical free-list
+//	48 freeCount   uint64 // the number of blocks in the physical free-list
+//	56 depth       uint16 // the number of levels of the page table
+//	58 freeDepth   uint16 // the number of levels of the physical free-list
+//	60 checksum    uint32 // CRC32C of the bytes before
+//
+// The valid slot with the highest txid is the current one. Commit writes the
+// other slot, after the fresh blocks were synced, so it flips the root
+// atomically.
+//
+// The physical blocks are allocated by the transactions as well, and not by
+// the allocator of the BlockFile: the blocks below highWater, that are not
+// reachable from the page table, are in the physical free-list. This is a
+// stack in another radix tree, whose entries are pairs of a physical
+// block-index and the ID of the transaction, that freed it. A block is only
+// reused, when no read-only transaction can see it anymore. The blocks, that
+// are replaced by a transaction, are pushed to the free-list of the new state.
+// So the allocations are only persisted by the flip of the meta slot, and after
+// a crash, the blocks of an uncommitted transaction are free again.
+const (
+	shadowFreeBit uint64 = 1 << 63
+
+	bfMetaSize = 64
+
+	metaTxIDOffset      = 0
+	metaRootOffset      = 8
+	metaNextOffset      = 16
+	metaFreeOffset      = 24
+	metaHighWaterOffset = 32
+	metaFreeRootOffset  = 40
+	metaFreeCountOffset = 48
+	metaDepthOffset     = 56
+	metaFreeDepthOffset = 58
+	metaChecksumOffset  = 60
+)
+
+// shadowTree is a radix tree of blocks with 64-bit entries.
+type shadowTree struct {
+	root  uint64 // the physical block-index of the root
+	depth uint32 // the number of levels
+}
+
+// shadowMeta is the content of a meta slot.
+type shadowMeta struct {
+	txid      uint64
+	pages     shadowTree // the page table
+	next      uint64
+	free      uint64
+	highWater uint64
+	freeList  shadowTree // the physical free-list
+	freeCount uint64
+}
+
+// Tx is a shadow-paging transaction, that was started by BlockFile.Begin. It
+// works on logical block-indices, which stay the same, when the block is
+// copied to a new physical block.
+//
+// A read-only Tx sees the state of the block-file at the time it was started,
+// until it is rolled back, even while other transactions are committed. A
+// writable Tx copies the blocks on the first write (see MapBlockForWrite),
+// so its changes are invisible to other transactions until Commit.
+//
+// There is at most one writable Tx at a time. A Tx must not be used by
+// multiple goroutines concurrently.
+type Tx struct {
+	bf       *BlockFile
+	writable bool
+	meta     shadowMeta
+	fanout   int64
+	fresh    map[int]bool // the physical blocks, that were allocated by the transaction
+	freed    []int        // the physical blocks, that are replaced by the transaction
+	spare    []int        // the fresh blocks, that were freed by the transaction
+	done     bool
+}
+
+// WithShadowPaging creates a block-file, that supports shadow-paging
+// transactions (see IncompatShadowPaging and BlockFile.Begin). The header
+// block stores two meta slots, so the data section (see BlockFile.MapHeader)
+// is 128 bytes smaller.
+func WithShadowPaging() Option {
+	return func(o *options) {
+		o.incompatFeatures |= IncompatShadowPaging
+	}
+}
+
+// hasShadowPaging returns true, when the blocks are managed by shadow-paging
+// transactions.
+func (bf *BlockFile) hasShadowPaging() bool {
+	return bf.incompat&IncompatShadowPaging != 0
+}
+
+// metaOffset returns the offset of the meta slots in the header block.
+func (bf *BlockFile) metaOffset() int {
+	if bf.incompat&IncompatLargeIndex != 0 {
+		return bfLargeFileHeaderSize
+	}
+	return bfFileHeaderSize
+}
+
+// readMeta returns the current meta slot, and its index.
+func (bf *BlockFile) readMeta(data []byte) (shadowMeta, int, error) {
+	var cur shadowMeta
+	slot := -1
+	for i := 0; i < 2; i++ {
+		buf := data[bf.metaOffset()+i*bfMetaSize:]
+		if crc32.Checksum(buf[:metaChecksumOffset], crc32cTable) != bf.order.Uint32(buf[metaChecksumOffset:]) {
+			continue
+		}
+		meta := shadowMeta{
+			txid:      bf.order.Uint64(buf[metaTxIDOffset:]),
+			pages:     shadowTree{bf.order.Uint64(buf[metaRootOffset:]), uint32(bf.order.Uint16(buf[metaDepthOffset:]))},
+			next:      bf.order.Uint64(buf[metaNextOffset:]),
+			free:      bf.order.Uint64(buf[metaFreeOffset:]),
+			highWater: bf.order.Uint64(buf[metaHighWaterOffset:]),
+			freeList:  shadowTree{bf.order.Uint64(buf[metaFreeRootOffset:]), uint32(bf.order.Uint16(buf[metaFreeDepthOffset:]))},
+			freeCount: bf.order.Uint64(buf[metaFreeCountOffset:]),
+		}
+		if slot == -1 || meta.txid > cur.txid {
+			cur, slot = meta, i
+		}
+	}
+	if slot == -1 {
+		return cur, 0, fmt.Errorf("BlockFile: no valid meta slot in the header block")
+	}
+	return cur, slot, nil
+}
+
+// writeMeta writes the meta slot with the given index.
+func (bf *BlockFile) writeMeta(data []byte, slot int, meta shadowMeta) {
+	buf := data[bf.metaOffset()+slot*bfMetaSize:]
+	bf.order.PutUint64(buf[metaTxIDOffset:], meta.txid)
+	bf.order.PutUint64(buf[metaRootOffset:], meta.pages.root)
+	bf.order.PutUint64(buf[metaNextOffset:], meta.next)
+	bf.order.PutUint64(buf[metaFreeOffset:], meta.free)
+	bf.order.PutUint64(buf[metaHighWaterOffset:], meta.highWater)
+	bf.order.PutUint64(buf[metaFreeRootOffset:], meta.freeList.root)
+	bf.order.PutUint64(buf[metaFreeCountOffset:], meta.freeCount)
+	bf.order.PutUint16(buf[metaDepthOffset:], uint16(meta.pages.depth))
+	bf.order.PutUint16(buf[metaFreeDepthOffset:], uint16(meta.freeList.depth))
+	bf.order.PutUint32(buf[metaChecksumOffset:], crc32.Checksum(buf[:metaChecksumOffset], crc32cTable))
+}
+
+// Begin starts a new shadow-paging transaction (see Tx). A writable
+// transaction waits until the current writable transaction (or the current
+// WALTx) is committed or rolled back. Every transaction must be finished by
+// Commit or Rollback, because the blocks, that it can see, are not reused
+// until then.
+// The physical blocks of a block-file with shadow paging can't be changed by
+// MapBlock, AllocateBlock or FreeBlock of the BlockFile (see ErrShadowPaging).
+// It returns ErrNoShadowPaging, when the block-file was not created with
+// WithShadowPaging.
+func (bf *BlockFile) Begin(writable bool) (*Tx, error) {
+	if !bf.hasShadowPaging() {
+		return nil, ErrNoShadowPaging
+	}
+	if writable && bf.readOnly {
+		return nil, ErrReadOnly
+	}
+	if writable {
+		bf.txMu.Lock()
+	}
+	tx := &Tx{bf: bf, writable: writable, fanout: int64(bf.BlockDataSize() / 8)}
+	bf.mu.RLock()
+	err := bf.mapHeaderBlock(bf, 0, func(hdr *bfHeader) (err error) {
+		tx.meta, _, err = bf.readMeta(hdr.data)
+		return err
+	})
+	if err == nil && !writable {
+		// register the reader, before a writer can free its blocks
+		bf.shadowMu.Lock()
+		if bf.readers == nil {
+			bf.readers = make(map[uint64]int)
+		}
+		bf.readers[tx.meta.txid]++
+		bf.shadowMu.Unlock()
+	}
+	bf.mu.RUnlock()
+	if err != nil {
+		if writable {
+			bf.txMu.Unlock()
+		}
+		return nil, err
+	}
+	if writable {
+		tx.fresh = make(map[int]bool)
+	}
+	return tx, nil
+}
+
+// ID returns the ID of the committed transaction, whose state the transaction
+// sees.
+func (tx *Tx) ID() uint64 {
+	return tx.meta.txid
+}
+
+// Writable returns true for a writable transaction.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// MapBlock maps the block with the given logical block-index, and calls the
+// handler. The handler must not write to the slice (see MapBlockForWrite).
+func (tx *Tx) MapBlock(block int, handler func([]byte) error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	phys, err := tx.lookup(block)
+	if err != nil {
+		return err
+	}
+	return tx.mapPhys(phys, false, handler)
+}
+
+// MapBlockForWrite maps the block with the given logical block-index for
+// writing, and calls the handler. On the first write in the transaction, the
+// block is copied to a new physical block, so the committed state is left
+// untouched.
+func (tx *Tx) MapBlockForWrite(block int, handler func([]byte) error) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if _, err := tx.lookup(block); err != nil {
+		return err
+	}
+	node, idx, err := tx.cowPath(&tx.meta.pages, int64(block))
+	if err != nil {
+		return err
+	}
+	entry, err := tx.entry(node, idx)
+	if err != nil {
+		return err
+	}
+	phys, err := tx.cow(int(entry))
+	if err != nil {
+		return err
+	}
+	if err := tx.setEntry(node, idx, uint64(phys)); err != nil {
+		return err
+	}
+	return tx.mapPhys(phys, true, handler)
+}
+
+// AllocateBlock allocates a new logical block, which is initialized with
+// zeros, and returns its logical block-index. Freed logical block-indices are
+// reused.
+func (tx *Tx) AllocateBlock() (int, error) {
+	if err := tx.checkWritable(); err != nil {
+		return 0, err
+	}
+	var block int
+	reused := tx.meta.free != 0
+	if reused {
+		block = int(tx.meta.free)
+	} else {
+		if tx.meta.next >= uint64(tx.bf.maxBlocks()) {
+			return 0, ErrBlockIndexOverflow
+		}
+		block = int(tx.meta.next)
+	}
+	node, idx, err := tx.cowPath(&tx.meta.pages, int64(block))
+	if err != nil {
+		return 0, err
+	}
+	phys, err := tx.allocateFresh()
+	if err != nil {
+		return 0, err
+	}
+	if reused {
+		entry, err := tx.entry(node, idx)
+		if err != nil {
+			return 0, err
+		}
+		tx.meta.free = entry &^ shadowFreeBit
+	} else {
+		tx.meta.next++
+	}
+	return block, tx.setEntry(node, idx, uint64(phys))
+}
+
+// FreeBlock frees the block with the given logical block-index. Its physical
+// block is reused, when no transaction can see it anymore.
+func (tx *Tx) FreeBlock(block int) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	phys, err := tx.lookup(block)
+	if err != nil {
+		return err
+	}
+	node, idx, err := tx.cowPath(&tx.meta.pages, int64(block))
+	if err != nil {
+		return err
+	}
+	if err := tx.setEntry(node, idx, shadowFreeBit|tx.meta.free); err != nil {
+		return err
+	}
+	tx.meta.free = uint64(block)
+	return tx.release(phys)
+}
+
+// Commit makes the changes of a writable transaction durable, and visible to
+// new transactions, by flipping the meta slot in the header block. The
+// high-water mark of the block-file (see BlockFile.NumBlocks) is set as well.
+// It returns ErrTxNotWritable for read-only transactions.
+func (tx *Tx) Commit() error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	bf := tx.bf
+	defer tx.finish()
+	if len(tx.fresh) == 0 && len(tx.freed) == 0 && len(tx.spare) == 0 {
+		return nil
+	}
+	// the replaced blocks are still used by the committed state, so they are
+	// only reused after the flip. Pushing them may replace blocks of the
+	// free-list itself, which are pushed as well.
+	txid := tx.meta.txid + 1
+	for len(tx.spare) > 0 || len(tx.freed) > 0 {
+		var phys int
+		if n := len(tx.spare); n > 0 {
+			phys, tx.spare = tx.spare[n-1], tx.spare[:n-1]
+			if err := tx.pushFree(phys, 0); err != nil {
+				return err
+			}
+		} else {
+			n := len(tx.freed)
+			phys, tx.freed = tx.freed[n-1], tx.freed[:n-1]
+			if err := tx.pushFree(phys, txid); err != nil {
+				return err
+			}
+		}
+	}
+	// the fresh blocks must be durable, before they are referenced
+	bf.mu.RLock()
+	for phys := range tx.fresh {
+		off, err := bf.blockOffset(phys)
+		if err == nil {
+			err = bf.mapRawBlock(phys, func(data []byte) error {
+				bf.setChecksum(data)
+				return nil
+			})
+		}
+		if err == nil {
+			err = syncMapperRange(bf.mapper, off, int(bf.blocksize))
+		}
+		if err != nil {
+			bf.mu.RUnlock()
+			return err
+		}
+	}
+	bf.mu.RUnlock()
+
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	meta := tx.meta
+	err := bf.updateHeaderBlock(bf, 0, func(hdr *bfHeader) error {
+		cur, slot, err := bf.readMeta(hdr.data)
+		if err != nil {
+			return err
+		}
+		meta.txid = cur.txid + 1
+		bf.writeMeta(hdr.data, 1-slot, meta)
+		bf.fileHeader(hdr).setHighWater(meta.highWater)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return syncMapperRange(bf.mapper, 0, int(bf.blocksize))
+}
+
+// Rollback discards the changes of a writable transaction, and ends a
+// read-only transaction. It does nothing, when the transaction was already
+// committed, so it can be deferred.
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	// the blocks, that were allocated by a writable transaction, are still
+	// free in the committed state
+	tx.finish()
+}
+
+func (tx *Tx) finish() {
+	tx.done = true
+	if tx.writable {
+		tx.fresh = nil
+		tx.bf.txMu.Unlock()
+		return
+	}
+	bf := tx.bf
+	bf.shadowMu.Lock()
+	if bf.readers[tx.meta.txid]--; bf.readers[tx.meta.txid] <= 0 {
+		delete(bf.readers, tx.meta.txid)
+	}
+	bf.shadowMu.Unlock()
+}
+
+// oldestReader returns the oldest transaction ID, that is seen by an open
+// read-only transaction.
+func (bf *BlockFile) oldestReader() uint64 {
+	bf.shadowMu.Lock()
+	defer bf.shadowMu.Unlock()
+	oldest := uint64(math.MaxUint64)
+	for txid := range bf.readers {
+		if txid < oldest {
+			oldest = txid
+		}
+	}
+	return oldest
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxDone
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return nil
+}
+
+// mapPhys maps the given physical block. The fresh blocks are not sealed
+// until the commit, so their checksums are not verified.
+func (tx *Tx) mapPhys(phys int, write bool, handler func([]byte) error) error {
+	return tx.bf.mapBlock(phys, !tx.fresh[phys], write, handler)
+}
+
+// lookup returns the physical block of the given logical block.
+func (tx *Tx) lookup(block int) (int, error) {
+	if block <= 0 || uint64(block) >= tx.meta.next {
+		return 0, fmt.Errorf("block %d is not allocated", block)
+	}
+	entry, err := tx.treeEntry(&tx.meta.pages, int64(block))
+	if err != nil {
+		return 0, err
+	}
+	if entry == 0 || entry&shadowFreeBit != 0 {
+		return 0, fmt.Errorf("block %d is not allocated", block)
+	}
+	return tx.bf.blockIndex(entry)
+}
+
+// treeEntry returns the entry with the given index in the radix tree, or 0,
+// when it doesn't exist.
+func (tx *Tx) treeEntry(t *shadowTree, i int64) (uint64, error) {
+	if t.depth == 0 || tx.capacity(t) <= i {
+		return 0, nil
+	}
+	node := int(t.root)
+	for level := int(t.depth) - 1; level > 0; level-- {
+		entry, err := tx.entry(node, tx.index(i, level))
+		if err != nil || entry == 0 {
+			return 0, err
+		}
+		node, err = tx.bf.blockIndex(entry)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return tx.entry(node, tx.index(i, 0))
+}
+
+// index returns the index of the entry for the given index of the radix tree
+// in a block of the given level (0 is the lowest level).
+func (tx *Tx) index(i int64, level int) int {
+	for ; level > 0 && i > 0; level-- {
+		i /= tx.fanout
+	}
+	return int(i % tx.fanout)
+}
+
+// capacity returns the number of entries, that fit into the radix tree.
+func (tx *Tx) capacity(t *shadowTree) int64 {
+	capacity := int64(1)
+	for i := uint32(0); i < t.depth; i++ {
+		if capacity > math.MaxInt64/tx.fanout {
+			return math.MaxInt64
+		}
+		capacity *= tx.fanout
+	}
+	return capacity
+}
+
+// cowPath copies the path in the radix tree to the entry with the given index
+// to fresh blocks (when they aren't fresh already), and returns the block of
+// the lowest level and the index of the entry in it. The tree grows, when the
+// index does not fit into it.
+func (tx *Tx) cowPath(t *shadowTree, i int64) (int, int, error) {
+	for t.depth == 0 || tx.capacity(t) <= i {
+		root, err := tx.allocateFresh()
+		if err != nil {
+			return 0, 0, err
+		}
+		if t.root != 0 {
+			if err := tx.setEntry(root, 0, t.root); err != nil {
+				return 0, 0, err
+			}
+		}
+		t.root = uint64(root)
+		t.depth++
+	}
+	node, err := tx.cow(int(t.root))
+	if err != nil {
+		return 0, 0, err
+	}
+	t.root = uint64(node)
+	for level := int(t.depth) - 1; level > 0; level-- {
+		idx := tx.index(i, level)
+		entry, err := tx.entry(node, idx)
+		if err != nil {
+			return 0, 0, err
+		}
+		var child int
+		if entry == 0 {
+			child, err = tx.allocateFresh()
+		} else {
+			child, err = tx.cow(int(entry))
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := tx.setEntry(node, idx, uint64(child)); err != nil {
+			return 0, 0, err
+		}
+		node = child
+	}
+	return node, tx.index(i, 0), nil
+}
+
+// cow returns a fresh copy of the given physical block. Fresh blocks are
+// returned as they are.
+func (tx *Tx) cow(phys int) (int, error) {
+	if tx.fresh[phys] {
+		return phys, nil
+	}
+	copied, err := tx.allocatePhys()
+	if err != nil {
+		return 0, err
+	}
+	tx.bf.mu.RLock()
+	defer tx.bf.mu.RUnlock()
+	err = tx.bf.readRawBlock(phys, func(src []byte) error {
+		if tx.bf.verify {
+			if err := tx.bf.verifyChecksum(phys, src); err != nil {
+				return err
+			}
+		}
+		return tx.bf.mapRawBlock(copied, func(dst []byte) error {
+			copy(dst, src)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	tx.freed = append(tx.freed, phys)
+	return copied, nil
+}
+
+// allocateFresh allocates a fresh physical block, that is initialized with
+// zeros.
+func (tx *Tx) allocateFresh() (int, error) {
+	phys, err := tx.allocatePhys()
+	if err != nil {
+		return 0, err
+	}
+	err = tx.bf.mapBlock(phys, false, true, func(data []byte) error {
+		for i := range data {
+			data[i] = 0
+		}
+		return nil
+	})
+	return phys, err
+}
+
+// allocatePhys allocates a physical block from the free-list, or after the
+// high-water mark of the transaction.
+func (tx *Tx) allocatePhys() (int, error) {
+	phys, err := tx.popFree()
+	if err != nil {
+		return 0, err
+	}
+	if phys == 0 {
+		if tx.meta.highWater >= uint64(tx.bf.maxBlocks()) {
+			return 0, ErrBlockIndexOverflow
+		}
+		phys = int(tx.meta.highWater)
+		tx.bf.mu.Lock()
+		err := tx.bf.growMapper(int64(phys) + 1)
+		tx.bf.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		tx.meta.highWater++
+	}
+	tx.fresh[phys] = true
+	return phys, nil
+}
+
+// popFree takes a block from the spare blocks of the transaction, or from
+// the free-list, when no transaction can see it anymore. It returns 0, when
+// there is no such block.
+func (tx *Tx) popFree() (int, error) {
+	if n := len(tx.spare); n > 0 {
+		phys := tx.spare[n-1]
+		tx.spare = tx.spare[:n-1]
+		return phys, nil
+	}
+	if tx.meta.freeCount == 0 {
+		return 0, nil
+	}
+	i := int64(tx.meta.freeCount - 1)
+	txid, err := tx.treeEntry(&tx.meta.freeList, 2*i+1)
+	if err != nil {
+		return 0, err
+	}
+	// the blocks, that were freed by newer transactions, are still used by
+	// the committed state or by a reader
+	if txid > tx.meta.txid || txid > tx.bf.oldestReader() {
+		return 0, nil
+	}
+	entry, err := tx.treeEntry(&tx.meta.freeList, 2*i)
+	if err != nil {
+		return 0, err
+	}
+	phys, err := tx.bf.blockIndex(entry)
+	if err != nil {
+		return 0, err
+	}
+	tx.meta.freeCount--
+	return phys, nil
+}
+
+// pushFree pushes the given physical block, that was freed by the transaction
+// with the given ID, to the free-list.
+func (tx *Tx) pushFree(phys int, txid uint64) error {
+	for {
+		i := tx.meta.freeCount
+		// copying the path may take blocks from the free-list
+		node, idx, err := tx.cowPath(&tx.meta.freeList, int64(2*i))
+		if err != nil {
+			return err
+		}
+		txNode, txIdx, err := tx.cowPath(&tx.meta.freeList, int64(2*i+1))
+		if err != nil {
+			return err
+		}
+		if tx.meta.freeCount != i {
+			continue
+		}
+		if err := tx.setEntry(node, idx, uint64(phys)); err != nil {
+			return err
+		}
+		if err := tx.setEntry(txNode, txIdx, txid); err != nil {
+			return err
+		}
+		tx.meta.freeCount++
+		return nil
+	}
+}
+
+// release frees a physical block, that is not used by the transaction
+// anymore. Fresh blocks can be reused by the transaction immediately.
+func (tx *Tx) release(phys int) error {
+	if !tx.fresh[phys] {
+		tx.freed = append(tx.freed, phys)
+		return nil
+	}
+	delete(tx.fresh, phys)
+	tx.spare = append(tx.spare, phys)
+	return nil
+}
+
+// entry returns the entry with the given index in a page-table block.
+func (tx *Tx) entry(node int, idx int) (uint64, error) {
+	var entry uint64
+	err := tx.mapPhys(node, false, func(data []byte) error {
+		entry = tx.bf.order.Uint64(data[idx*8:])
+		return nil
+	})
+	return entry, err
+}
+
+// setEntry changes the entry with the given index in a fresh page-table
+// block.
+func (tx *Tx) setEntry(node int, idx int, entry uint64) error {
+	return tx.mapPhys(node, true, func(data []byte) error {
+		tx.bf.order.PutUint64(data[idx*8:], entry)
+		return nil
+	})
+}
@@ -0,0 +1,333 @@
+package mmf_test
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func readTxValue(tx *Tx, block int, t *testing.T) uint64 {
+	var val uint64
+	err := tx.MapBlock(block, func(data []byte) error {
+		val = binary.LittleEndian.Uint64(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block", block, err)
+	}
+	return val
+}
+
+func writeTxValue(tx *Tx, block int, val uint64, t *testing.T) {
+	err := tx.MapBlockForWrite(block, func(data []byte) error {
+		binary.LittleEndian.PutUint64(data, val)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block for write", block, err)
+	}
+}
+
+func TestShadowPaging(t *testing.T) {
+	plain, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(128), 128)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := plain.Begin(false); err != ErrNoShadowPaging {
+		t.Error("expected ErrNoShadowPaging, got", err)
+	}
+
+	mapper := NewMemoryMapper(256)
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 256, WithShadowPaging())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	// 40 blocks need two levels in the page table (32 entries per block)
+	tx, err := bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	var blocks []int
+	for i := 0; i < 40; i++ {
+		block, err := tx.AllocateBlock()
+		if err != nil {
+			t.Fatal("Error while allocating block:", err)
+		}
+		writeTxValue(tx, block, uint64(i), t)
+		blocks = append(blocks, block)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+
+	// the physical blocks are managed by the transactions only
+	if _, err := bf.AllocateBlock(); err != ErrShadowPaging {
+		t.Error("expected ErrShadowPaging from AllocateBlock, got", err)
+	}
+	if err := bf.FreeBlock(1); err != ErrShadowPaging {
+		t.Error("expected ErrShadowPaging from FreeBlock, got", err)
+	}
+	if err := bf.MapBlock(1, func([]byte) error { return nil }); err != ErrShadowPaging {
+		t.Error("expected ErrShadowPaging from MapBlock, got", err)
+	}
+	if err := bf.StoreUint32(1, 0, 1); err != ErrShadowPaging {
+		t.Error("expected ErrShadowPaging from StoreUint32, got", err)
+	}
+
+	// a reader keeps seeing its snapshot
+	reader, err := bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if err := reader.Commit(); err != ErrTxNotWritable {
+		t.Error("expected ErrTxNotWritable, got", err)
+	}
+	tx, err = bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	writeTxValue(tx, blocks[5], 500, t)
+	if err := tx.FreeBlock(blocks[7]); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	if val := readTxValue(reader, blocks[5], t); val != 5 {
+		t.Error("the reader sees the changes of a newer transaction", val)
+	}
+	if val := readTxValue(reader, blocks[7], t); val != 7 {
+		t.Error("the reader sees the changes of a newer transaction", val)
+	}
+	reader2, err := bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if reader2.ID() != reader.ID()+1 {
+		t.Error("unexpected transaction ID", reader2.ID())
+	}
+	if val := readTxValue(reader2, blocks[5], t); val != 500 {
+		t.Error("the committed change is not visible", val)
+	}
+	if err := reader2.MapBlock(blocks[7], func([]byte) error { return nil }); err == nil {
+		t.Error("the freed block is still visible")
+	}
+	reader2.Rollback()
+	reader.Rollback()
+
+	// without readers, the replaced blocks are reused
+	numBlocks, _ := bf.NumBlocks()
+	for i := 0; i < 5; i++ {
+		tx, err := bf.Begin(true)
+		if err != nil {
+			t.Fatal("Error while starting transaction:", err)
+		}
+		writeTxValue(tx, blocks[1], uint64(i), t)
+		if err := tx.Commit(); err != nil {
+			t.Fatal("Error while committing:", err)
+		}
+	}
+	if n, _ := bf.NumBlocks(); n != numBlocks {
+		t.Error("the replaced blocks were not reused", numBlocks, n)
+	}
+
+	// rolled back changes are discarded, and the freed logical block is reused
+	tx, err = bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if block, err := tx.AllocateBlock(); err != nil || block != blocks[7] {
+		t.Error("the freed logical block was not reused", block, err)
+	}
+	writeTxValue(tx, blocks[5], 0, t)
+	tx.Rollback()
+
+	bf2, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	reader, err = bf2.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if val := readTxValue(reader, blocks[5], t); val != 500 {
+		t.Error("unexpected value after reopening", val)
+	}
+	if val := readTxValue(reader, blocks[39], t); val != 39 {
+		t.Error("unexpected value after reopening", val)
+	}
+	reader.Rollback()
+
+	// a torn meta slot is ignored: the replaced blocks are still in use by
+	// the reader, so the previous state is intact
+	reader, err = bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	defer reader.Rollback()
+	tx, err = bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	writeTxValue(tx, blocks[1], 99, t)
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	data := mapper.Bytes()
+	slot := 32
+	if binary.LittleEndian.Uint64(data[slot+64:]) > binary.LittleEndian.Uint64(data[slot:]) {
+		slot += 64
+	}
+	data[slot+8] ^= 1
+	reader2, err = bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	defer reader2.Rollback()
+	if reader2.ID() != reader.ID() {
+		t.Error("the previous meta slot was not used", reader2.ID())
+	}
+	if val := readTxValue(reader2, blocks[1], t); val != 4 {
+		t.Error("unexpected value in the previous state", val)
+	}
+}
+
+func TestShadowPagingConcurrent(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithOptions(NewMemoryMapper(256), 256, WithShadowPaging())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	tx, err := bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	a, _ := tx.AllocateBlock()
+	b, _ := tx.AllocateBlock()
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tx, err := bf.Begin(false)
+				if err != nil {
+					t.Error("Error while starting transaction:", err)
+					return
+				}
+				// both blocks are always changed together
+				if va, vb := readTxValue(tx, a, t), readTxValue(tx, b, t); va != vb {
+					t.Error("inconsistent snapshot", va, vb)
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+	for i := uint64(1); i <= 100; i++ {
+		tx, err := bf.Begin(true)
+		if err != nil {
+			t.Fatal("Error while starting transaction:", err)
+		}
+		writeTxValue(tx, a, i, t)
+		writeTxValue(tx, b, i, t)
+		if err := tx.Commit(); err != nil {
+			t.Fatal("Error while committing:", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestShadowPagingCrash(t *testing.T) {
+	mapper := &crashingMapper{MemoryMapper: NewMemoryMapper(256)}
+	bf, err := CreateBlockFileInMapperWithOptions(mapper, 256, WithShadowPaging())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	tx, err := bf.Begin(true)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	a, _ := tx.AllocateBlock()
+	b, _ := tx.AllocateBlock()
+	writeTxValue(tx, a, 1, t)
+	writeTxValue(tx, b, 2, t)
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	for i := uint64(10); i < 13; i++ {
+		tx, err := bf.Begin(true)
+		if err != nil {
+			t.Fatal("Error while starting transaction:", err)
+		}
+		writeTxValue(tx, a, i, t)
+		if err := tx.Commit(); err != nil {
+			t.Fatal("Error while committing:", err)
+		}
+	}
+	numBlocks, _ := bf.NumBlocks()
+
+	// crash before the commit of a transaction, that reuses freed blocks, and
+	// allocates blocks after the high-water mark
+	change := func(bf *BlockFile) *Tx {
+		tx, err := bf.Begin(true)
+		if err != nil {
+			t.Fatal("Error while starting transaction:", err)
+		}
+		writeTxValue(tx, a, 100, t)
+		if err := tx.FreeBlock(b); err != nil {
+			t.Fatal("Error while freeing block:", err)
+		}
+		for i := 0; i < 40; i++ {
+			block, err := tx.AllocateBlock()
+			if err != nil {
+				t.Fatal("Error while allocating block:", err)
+			}
+			writeTxValue(tx, block, 200, t)
+		}
+		return tx
+	}
+	tx = change(bf)
+	mapper.crashed = true
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected an error from the crashed mapper")
+	}
+	mapper.crashed = false
+	size := len(mapper.Bytes())
+
+	recovered := NewMemoryMapperFromBytes(append([]byte(nil), mapper.Bytes()...))
+	bf, err = OpenBlockFileFromMapper(recovered)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if n, _ := bf.NumBlocks(); n != numBlocks {
+		t.Error("unexpected number of blocks after the crash", n, "expected", numBlocks)
+	}
+	reader, err := bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if va, vb := readTxValue(reader, a, t), readTxValue(reader, b, t); va != 12 || vb != 2 {
+		t.Error("unexpected values after the crash", va, vb)
+	}
+	reader.Rollback()
+
+	// the blocks of the crashed transaction are free again
+	if err := change(bf).Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	if len(recovered.Bytes()) != size {
+		t.Error("the blocks of the crashed transaction were leaked", len(recovered.Bytes()), size)
+	}
+	reader, err = bf.Begin(false)
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	defer reader.Rollback()
+	if va := readTxValue(reader, a, t); va != 100 {
+		t.Error("unexpected value after the commit", va)
+	}
+}
@@ -0,0 +1,327 @@
+package mmf
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// SharedMutexSize is the number of bytes, that a SharedMutex occupies in
+	// the mapped memory. It must be aligned to 4 bytes.
+	SharedMutexSize = 4
+	// SharedCondSize is the number of bytes, that a SharedCond occupies in the
+	// mapped memory. It must be aligned to 4 bytes.
+	SharedCondSize = 4
+)
+
+// ErrOwnerDead is returned by SharedMutex.Lock and SharedMutex.TryLock, when
+// the mutex was locked by a process that does not exist anymore. The mutex is
+// locked by the caller nevertheless, but the data that is protected by the
+// mutex may be inconsistent, and should be checked (or repaired) before
+// Unlock is called.
+var ErrOwnerDead = errors.New("SharedMutex: the previous owner died")
+
+// The state of a SharedMutex is a single uint32: 0 when it is unlocked,
+// otherwise the PID of the owning process, with the mutexWaiters bit set, when
+// other goroutines or processes may be waiting.
+const mutexWaiters = 1 << 31
+
+// mutexRecheckInterval is the longest time a waiter sleeps, before it checks
+// again, if the owner of the mutex is still alive.
+const mutexRecheckInterval = 50 * time.Millisecond
+
+// The interval, in which a waiter polls the value, when it can't wait on a
+// futex (see pollUint32), starts at mutexPollInterval, and is doubled up to
+// mutexMaxPollInterval.
+const (
+	mutexPollInterval    = 50 * time.Microsecond
+	mutexMaxPollInterval = 2 * time.Millisecond
+)
+
+// SharedMutex is a mutual exclusion lock, that is stored in the mapped memory
+// (see MappedFile.SharedMutexAt and BlockFile.SharedMutexAt), so it can be
+// used by multiple processes, that map the same file, and by multiple
+// goroutines. The zero value (4 zero bytes) is an unlocked mutex.
+//
+// Waiting uses a futex on Linux. On other platforms, and for mutexes in a
+// BlockFile (which must not be mapped while the waiter sleeps), waiters sleep
+// and poll.
+// The mutex stores the PID of the owning process, so a mutex, that is held by
+// a process that died, is taken over by the next Lock (see ErrOwnerDead). This
+// does not detect a dead owner, when the PID was reused in the meantime, and
+// doesn't work across PID namespaces.
+// A SharedMutex is not associated with a goroutine, so it can be unlocked by
+// an other goroutine of the owning process. Goroutines should share the same
+// *SharedMutex, so that the race detector sees, that the mutex orders their
+// accesses.
+type SharedMutex struct {
+	mapState  func(func(*uint32) error) error
+	waitState func(val uint32, timeout time.Duration) error
+}
+
+// SharedCond is a condition variable, that is stored in the mapped memory (see
+// MappedFile.SharedCondAt and BlockFile.SharedCondAt) and is used with a
+// SharedMutex. Like with sync.Cond, Wait must be called in a loop, that
+// checks the condition, because spurious wake-ups are possible. The zero
+// value (4 zero bytes) is a valid condition variable.
+type SharedCond struct {
+	mapSeq  func(func(*uint32) error) error
+	waitSeq func(val uint32, timeout time.Duration) error
+}
+
+// SharedMutexAt returns the SharedMutex, that is stored at the given offset.
+// It returns ErrUnaligned, when the offset is not aligned to 4 bytes.
+func (mf *MappedFile) SharedMutexAt(off int64) (*SharedMutex, error) {
+	m := &SharedMutex{mapState: mf.mapUint32(off), waitState: mf.waitUint32(off)}
+	if err := m.mapState(func(*uint32) error { return nil }); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SharedCondAt returns the SharedCond, that is stored at the given offset.
+// It returns ErrUnaligned, when the offset is not aligned to 4 bytes.
+func (mf *MappedFile) SharedCondAt(off int64) (*SharedCond, error) {
+	c := &SharedCond{mapSeq: mf.mapUint32(off), waitSeq: mf.waitUint32(off)}
+	if err := c.mapSeq(func(*uint32) error { return nil }); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (mf *MappedFile) mapUint32(off int64) func(func(*uint32) error) error {
+	return func(handler func(*uint32) error) error {
+		return mf.Map(off, 4, func(data []byte) error {
+			p, err := uint32Ptr(data)
+			if err != nil {
+				return err
+			}
+			return handler(p)
+		})
+	}
+}
+
+// waitUint32 waits on the futex at the given offset. MappedFile.Map doesn't
+// hold a lock, while the handler runs, so the futex is waited on in the
+// handler.
+func (mf *MappedFile) waitUint32(off int64) func(uint32, time.Duration) error {
+	mapUint32 := mf.mapUint32(off)
+	return func(val uint32, timeout time.Duration) error {
+		return mapUint32(func(p *uint32) error {
+			futexWait(p, val, timeout)
+			return nil
+		})
+	}
+}
+
+// SharedMutexAt returns the SharedMutex, that is stored at the given offset in
+// the given block.
+// It returns ErrUnaligned, when the offset is not aligned to 4 bytes.
+// It returns ErrChecksummedValue, when the block-file has checksums.
+func (bf *BlockFile) SharedMutexAt(block int, off int) (*SharedMutex, error) {
+	m := &SharedMutex{mapState: bf.mapUint32(block, off, true), waitState: pollUint32(bf.mapUint32(block, off, false))}
+	if err := m.mapState(func(*uint32) error { return nil }); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SharedCondAt returns the SharedCond, that is stored at the given offset in
+// the given block.
+// It returns ErrUnaligned, when the offset is not aligned to 4 bytes.
+// It returns ErrChecksummedValue, when the block-file has checksums.
+func (bf *BlockFile) SharedCondAt(block int, off int) (*SharedCond, error) {
+	c := &SharedCond{mapSeq: bf.mapUint32(block, off, true), waitSeq: pollUint32(bf.mapUint32(block, off, false))}
+	if err := c.mapSeq(func(*uint32) error { return nil }); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mapUint32 returns a function, that maps the uint32 at the given offset. The
+// polling waiters only load the value, so they don't map it for writing.
+func (bf *BlockFile) mapUint32(block int, off int, write bool) func(func(*uint32) error) error {
+	return func(handler func(*uint32) error) error {
+		return bf.mapValue(block, off, 4, write, func(data []byte) error {
+			p, err := uint32Ptr(data)
+			if err != nil {
+				return err
+			}
+			return handler(p)
+		})
+	}
+}
+
+// pollUint32 returns a function, that waits until the value is not val
+// anymore, or the timeout expired. It polls the value, and doesn't hold the
+// mapping while it sleeps, because a BlockFile holds its read-lock, while a
+// handler runs (which would stall AllocateBlock, FreeBlock and the other
+// handlers). So the waiters are not woken up by futexWake.
+func pollUint32(mapUint32 func(func(*uint32) error) error) func(uint32, time.Duration) error {
+	return func(val uint32, timeout time.Duration) error {
+		deadline := time.Now().Add(timeout)
+		for sleep := mutexPollInterval; ; sleep *= 2 {
+			changed := false
+			err := mapUint32(func(p *uint32) error {
+				changed = atomic.LoadUint32(p) != val
+				return nil
+			})
+			if err != nil || changed {
+				return err
+			}
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil
+			}
+			if sleep > mutexMaxPollInterval {
+				sleep = mutexMaxPollInterval
+			}
+			if sleep > remaining {
+				sleep = remaining
+			}
+			time.Sleep(sleep)
+		}
+	}
+}
+
+// Lock locks the mutex, and waits until it is available. When the mutex was
+// held by a process that died, it is locked, and ErrOwnerDead is returned.
+// It returns an error, if any.
+func (m *SharedMutex) Lock() error {
+	return m.lock(true)
+}
+
+// TryLock tries to lock the mutex without waiting. It returns false, if the
+// mutex is locked by someone else. When the mutex was held by a process that
+// died, it is locked, and true and ErrOwnerDead is returned.
+func (m *SharedMutex) TryLock() (bool, error) {
+	err := m.lock(false)
+	if err == errMutexLocked {
+		return false, nil
+	}
+	return err == nil || err == ErrOwnerDead, err
+}
+
+var errMutexLocked = errors.New("SharedMutex: locked")
+
+func (m *SharedMutex) lock(wait bool) error {
+	pid := uint32(os.Getpid())
+	waited := false
+	for {
+		acquired := false
+		ownerDead := false
+		var waitFor uint32 // the state to wait on, or 0 to retry immediately
+		err := m.mapState(func(state *uint32) error {
+			cur := atomic.LoadUint32(state)
+			if cur == 0 {
+				// after waiting, there may be other waiters, that need to be woken
+				// up by Unlock
+				locked := pid
+				if waited {
+					locked |= mutexWaiters
+				}
+				acquired = atomic.CompareAndSwapUint32(state, 0, locked)
+				return nil
+			}
+			if owner := cur &^ mutexWaiters; owner != pid && !processAlive(int(owner)) {
+				acquired = atomic.CompareAndSwapUint32(state, cur, pid|cur&mutexWaiters)
+				ownerDead = acquired
+				return nil
+			}
+			if !wait {
+				return errMutexLocked
+			}
+			if cur&mutexWaiters == 0 && !atomic.CompareAndSwapUint32(state, cur, cur|mutexWaiters) {
+				return nil
+			}
+			waitFor = cur | mutexWaiters
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if acquired {
+			raceAcquire(unsafe.Pointer(m))
+			if ownerDead {
+				return ErrOwnerDead
+			}
+			return nil
+		}
+		if waitFor != 0 {
+			// the state is not mapped while waiting
+			if err := m.waitState(waitFor, mutexRecheckInterval); err != nil {
+				return err
+			}
+			waited = true
+		}
+	}
+}
+
+// Unlock unlocks the mutex, and wakes up a waiter.
+// It returns an error, when the mutex is not locked.
+func (m *SharedMutex) Unlock() error {
+	raceReleaseMerge(unsafe.Pointer(m))
+	return m.mapState(func(state *uint32) error {
+		for {
+			cur := atomic.LoadUint32(state)
+			if cur == 0 {
+				return errors.New("SharedMutex: unlock of unlocked mutex")
+			}
+			if atomic.CompareAndSwapUint32(state, cur, 0) {
+				if cur&mutexWaiters != 0 {
+					futexWake(state, 1)
+				}
+				return nil
+			}
+		}
+	})
+}
+
+// Wait unlocks the mutex, waits until it is woken up by Signal or Broadcast,
+// and locks the mutex again before it returns. The mutex must be locked by the
+// caller. Like Lock, it returns ErrOwnerDead, when the mutex was taken over
+// from a process that died.
+func (c *SharedCond) Wait(m *SharedMutex) error {
+	var seq uint32
+	err := c.mapSeq(func(p *uint32) error {
+		seq = atomic.LoadUint32(p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.Unlock(); err != nil {
+		return err
+	}
+	err = c.waitSeq(seq, mutexRecheckInterval)
+	if lockErr := m.Lock(); lockErr != nil {
+		return lockErr
+	}
+	return err
+}
+
+// Signal wakes up one goroutine or process, that is waiting on the condition
+// variable.
+// It returns an error, if any.
+func (c *SharedCond) Signal() error {
+	return c.wake(1)
+}
+
+// Broadcast wakes up all goroutines and processes, that are waiting on the
+// condition variable.
+// It returns an error, if any.
+func (c *SharedCond) Broadcast() error {
+	return c.wake(math.MaxInt32)
+}
+
+func (c *SharedCond) wake(n int) error {
+	return c.mapSeq(func(p *uint32) error {
+		atomic.AddUint32(p, 1)
+		futexWake(p, n)
+		return nil
+	})
+}
@@ -0,0 +1,199 @@
+package mmf_test
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func TestSharedMutex(t *testing.T) {
+	mf, err := NewAnonymousMapping(4096)
+	if err != nil {
+		t.Fatal("Error while creating anonymous mapping:", err)
+	}
+	defer closeMF(mf, t)
+	if _, err := mf.SharedMutexAt(2); err != ErrUnaligned {
+		t.Error("expected ErrUnaligned, got", err)
+	}
+	m, err := mf.SharedMutexAt(0)
+	if err != nil {
+		t.Fatal("Error while getting mutex:", err)
+	}
+	counter := 0
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := m.Lock(); err != nil {
+					t.Error("Error while locking:", err)
+					return
+				}
+				counter++
+				if err := m.Unlock(); err != nil {
+					t.Error("Error while unlocking:", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if counter != 1600 {
+		t.Error("unexpected counter", counter)
+	}
+	if ok, err := m.TryLock(); !ok || err != nil {
+		t.Error("expected TryLock to succeed, got", ok, err)
+	}
+	if ok, err := m.TryLock(); ok || err != nil {
+		t.Error("expected TryLock to fail, got", ok, err)
+	}
+	if err := m.Unlock(); err != nil {
+		t.Error("Error while unlocking:", err)
+	}
+	if err := m.Unlock(); err == nil {
+		t.Error("expected an error when unlocking an unlocked mutex")
+	}
+}
+
+func TestSharedCond(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block", err)
+	}
+	m, err := bf.SharedMutexAt(block, 0)
+	if err != nil {
+		t.Fatal("Error while getting mutex:", err)
+	}
+	c, err := bf.SharedCondAt(block, SharedMutexSize)
+	if err != nil {
+		t.Fatal("Error while getting condition variable:", err)
+	}
+	const items = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= items; i++ {
+			if err := m.Lock(); err != nil {
+				t.Error("Error while locking:", err)
+				return
+			}
+			if err := bf.StoreUint32(block, 8, uint32(i)); err != nil {
+				t.Error("Error while storing:", err)
+			}
+			c.Broadcast()
+			m.Unlock()
+		}
+	}()
+	if err := m.Lock(); err != nil {
+		t.Fatal("Error while locking:", err)
+	}
+	for {
+		v, err := bf.LoadUint32(block, 8)
+		if err != nil {
+			t.Fatal("Error while loading:", err)
+		}
+		if v == items {
+			break
+		}
+		if err := c.Wait(m); err != nil {
+			t.Fatal("Error while waiting:", err)
+		}
+	}
+	m.Unlock()
+	<-done
+}
+
+func TestBlockSharedMutexWaiter(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block", err)
+	}
+	m, err := bf.SharedMutexAt(block, 0)
+	if err != nil {
+		t.Fatal("Error while getting mutex:", err)
+	}
+	if err := m.Lock(); err != nil {
+		t.Fatal("Error while locking:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := m.Lock(); err != nil {
+			t.Error("Error while locking:", err)
+			return
+		}
+		m.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// a waiting goroutine must not hold the read-lock of the BlockFile, while
+	// it sleeps
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, err := bf.AllocateBlock(); err != nil {
+			t.Fatal("Error while allocating block", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("AllocateBlock was stalled by a waiter for", elapsed)
+	}
+	if err := m.Unlock(); err != nil {
+		t.Error("Error while unlocking:", err)
+	}
+	<-done
+}
+
+func TestSharedMutexOwnerDead(t *testing.T) {
+	if filename := os.Getenv("MMF_SHARED_MUTEX_HELPER"); filename != "" {
+		// lock the mutex and exit without unlocking it
+		mf, err := OpenMappedFile(filename)
+		if err != nil {
+			os.Exit(2)
+		}
+		m, err := mf.SharedMutexAt(0)
+		if err != nil || m.Lock() != nil {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+	if runtime.GOOS == "js" || runtime.GOOS == "wasip1" || runtime.GOOS == "plan9" {
+		t.Skip("can't create processes on", runtime.GOOS)
+	}
+	defer os.Remove("test14.tmp")
+	mf, err := CreateMappedFile("test14.tmp", 4096)
+	if err != nil {
+		t.Fatal("Error while creating file:", err)
+	}
+	defer closeMF(mf, t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSharedMutexOwnerDead$")
+	cmd.Env = append(os.Environ(), "MMF_SHARED_MUTEX_HELPER=test14.tmp")
+	if err := cmd.Run(); err != nil {
+		t.Fatal("Error in helper process:", err)
+	}
+	m, err := mf.SharedMutexAt(0)
+	if err != nil {
+		t.Fatal("Error while getting mutex:", err)
+	}
+	if ok, err := m.TryLock(); !ok || err != ErrOwnerDead {
+		t.Error("expected ErrOwnerDead, got", ok, err)
+	}
+	if err := m.Unlock(); err != nil {
+		t.Error("Error while unlocking:", err)
+	}
+	if err := m.Lock(); err != nil {
+		t.Error("Error while locking:", err)
+	}
+}
@@ -0,0 +1,232 @@
+package mmf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSnapshotClosed is returned by the methods of a Snapshot, that was closed.
+var ErrSnapshotClosed = errors.New("BlockFile: the snapshot is closed")
+
+// Snapshot is a read-only view of a BlockFile, that was created by
+// BlockFile.Snapshot. It stays consistent, while the block-file is changed:
+// before a block is mapped for writing by the BlockFile for the first time
+// after the snapshot was created, a copy of the block is made for the
+// snapshot. Blocks are mapped for writing by MapBlock (its handlers may write
+// to them), by the atomic operations, that change values, and by the
+// allocation, but not by the loads and the internal reads. So the memory,
+// that is used by a snapshot, grows with the number of blocks, that are
+// changed, and long-living snapshots should be avoided.
+//
+// The blocks, that are freed by FreeBlock while a snapshot is open, are held
+// back from the free-list, until all snapshots, that were created before, are
+// closed. So they are not reused by AllocateBlock in the meantime. Close of
+// the BlockFile closes the open snapshots and frees the held blocks. The held
+// blocks are only kept in memory, and they are not recovered, when the
+// block-file is opened again: when the process ends without closing the
+// BlockFile, they stay allocated, and are never reused.
+//
+// The handlers of MapBlock and MapHeader must not write to the slice, and
+// must not call methods of the BlockFile. A Snapshot is safe for concurrent
+// use by multiple goroutines.
+type Snapshot struct {
+	bf        *BlockFile
+	seq       uint64
+	numBlocks int
+	images    map[int][]byte // the copies of the blocks (guarded by snapMu), including the header block
+	closed    bool
+}
+
+// heldBlock is a block, that was freed, while snapshots were open.
+type heldBlock struct {
+	block int
+	seq   uint64 // the sequence number of the newest snapshot at the time
+}
+
+// Snapshot creates a read-only view of the block-file, that is not affected by
+// later changes (see Snapshot). It must be closed, when it isn't needed
+// anymore. It waits for the running handlers of MapBlock and MapHeader, so
+// their changes are either completely visible or not at all.
+// It returns an error, if any.
+func (bf *BlockFile) Snapshot() (*Snapshot, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	s := &Snapshot{bf: bf, images: make(map[int][]byte)}
+	err := bf.mapper.Map(0, int(bf.blocksize), func(data []byte) error {
+		hdr, err := bfHeaderFromSlice(data)
+		if err != nil {
+			return err
+		}
+		highWater := bf.fileHeader(hdr).highWater()
+		if highWater > uint64(bf.maxBlocks()) {
+			return ErrBlockIndexOverflow
+		}
+		s.numBlocks = int(highWater)
+		s.images[0] = append([]byte(nil), data...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bf.snapMu.Lock()
+	defer bf.snapMu.Unlock()
+	if bf.snapshots == nil {
+		bf.snapshots = make(map[*Snapshot]struct{})
+	}
+	bf.snapSeq++
+	s.seq = bf.snapSeq
+	bf.snapshots[s] = struct{}{}
+	return s, nil
+}
+
+// NumBlocks returns the number of blocks (including the header block) at the
+// time, the snapshot was created.
+func (s *Snapshot) NumBlocks() int {
+	return s.numBlocks
+}
+
+// MapBlock maps the block with the given index, as it was at the time the
+// snapshot was created, and calls the handler (see BlockFile.MapBlock).
+func (s *Snapshot) MapBlock(block int, handler func([]byte) error) error {
+	if block <= 0 {
+		return fmt.Errorf("can't map block 0. This is the header-block.")
+	}
+	if block >= s.numBlocks {
+		return fmt.Errorf("block %d is not allocated", block)
+	}
+	return s.mapBlock(block, func(data []byte) error {
+		return handler(data[:len(data)-s.bf.checksumSize()])
+	})
+}
+
+// MapHeader maps the data section of the header block, as it was at the time
+// the snapshot was created, and calls the handler (see BlockFile.MapHeader).
+func (s *Snapshot) MapHeader(handler func(data []byte, contentType uint32) error) error {
+	return s.mapBlock(0, func(data []byte) error {
+		hdr := &bfHeader{data: data, order: s.bf.order}
+		if handler != nil {
+			return handler(data[s.bf.fileHeaderSize():len(data)-s.bf.checksumSize()], hdr.contentType())
+		}
+		return nil
+	})
+}
+
+// mapBlock maps the copy of the given block, or the block itself, when it was
+// not changed since the snapshot was created. The read-lock on the snapshots
+// is held while the handler runs, so the block isn't changed in the meantime.
+func (s *Snapshot) mapBlock(block int, handler func([]byte) error) error {
+	bf := s.bf
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	bf.snapMu.RLock()
+	defer bf.snapMu.RUnlock()
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	if image, ok := s.images[block]; ok {
+		return handler(image)
+	}
+	return bf.mapRawBlockUnpreserved(block, handler)
+}
+
+// Close closes the snapshot, and frees the blocks, that were held back for
+// it.
+// It returns an error, if any.
+func (s *Snapshot) Close() error {
+	bf := s.bf
+	bf.snapMu.Lock()
+	if s.closed {
+		bf.snapMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.images = nil
+	delete(bf.snapshots, s)
+	oldest := bf.snapSeq + 1
+	for other := range bf.snapshots {
+		if other.seq < oldest {
+			oldest = other.seq
+		}
+	}
+	var blocks []int
+	held := bf.heldBlocks[:0]
+	for _, h := range bf.heldBlocks {
+		if h.seq < oldest {
+			blocks = append(blocks, h.block)
+		} else {
+			held = append(held, h)
+		}
+	}
+	bf.heldBlocks = held
+	bf.snapMu.Unlock()
+	if len(blocks) == 0 {
+		return nil
+	}
+	_, err := bf.freeBlocksNow(blocks)
+	return err
+}
+
+// closeSnapshots closes all open snapshots, and returns the blocks, that were
+// held back for them.
+func (bf *BlockFile) closeSnapshots() []int {
+	bf.snapMu.Lock()
+	defer bf.snapMu.Unlock()
+	for s := range bf.snapshots {
+		s.closed = true
+		s.images = nil
+	}
+	bf.snapshots = nil
+	blocks := make([]int, 0, len(bf.heldBlocks))
+	for _, h := range bf.heldBlocks {
+		blocks = append(blocks, h.block)
+	}
+	bf.heldBlocks = nil
+	return blocks
+}
+
+// preserve copies the given (whole) block for the open snapshots, that don't
+// have a copy yet, before it is mapped.
+func (bf *BlockFile) preserve(block int, data []byte) {
+	bf.snapMu.RLock()
+	missing := false
+	for s := range bf.snapshots {
+		if _, ok := s.images[block]; !ok && block < s.numBlocks {
+			missing = true
+			break
+		}
+	}
+	bf.snapMu.RUnlock()
+	if !missing {
+		return
+	}
+	bf.snapMu.Lock()
+	defer bf.snapMu.Unlock()
+	for s := range bf.snapshots {
+		if _, ok := s.images[block]; !ok && block < s.numBlocks {
+			s.images[block] = append([]byte(nil), data...)
+		}
+	}
+}
+
+// holdBack holds the given blocks back from the free-list, when snapshots are
+// open. It returns false, when the blocks have to be freed now.
+func (bf *BlockFile) holdBack(blocks []int) (bool, error) {
+	numBlocks, err := bf.NumBlocks()
+	if err != nil {
+		return false, err
+	}
+	bf.snapMu.Lock()
+	defer bf.snapMu.Unlock()
+	if len(bf.snapshots) == 0 {
+		return false, nil
+	}
+	for _, block := range blocks {
+		if block <= 0 || block >= numBlocks {
+			return true, fmt.Errorf("block %d is not allocated", block)
+		}
+	}
+	for _, block := range blocks {
+		bf.heldBlocks = append(bf.heldBlocks, heldBlock{block: block, seq: bf.snapSeq})
+	}
+	return true, nil
+}
@@ -0,0 +1,214 @@
+package mmf_test
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func readSnapshotValue(s *Snapshot, block int, t *testing.T) uint64 {
+	var val uint64
+	err := s.MapBlock(block, func(data []byte) error {
+		val = binary.LittleEndian.Uint64(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block", block, err)
+	}
+	return val
+}
+
+func writeBlockValue(bf *BlockFile, block int, val uint64, t *testing.T) {
+	err := bf.MapBlock(block, func(data []byte) error {
+		binary.LittleEndian.PutUint64(data, val)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block", block, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithOptions(NewMemoryMapper(64), 64, WithChecksums())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	blocks, err := bf.AllocateBlocks(3)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	for i, block := range blocks {
+		writeBlockValue(bf, block, uint64(i+1), t)
+		if err := bf.SealBlock(block); err != nil {
+			t.Fatal("Error while sealing block:", err)
+		}
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		binary.LittleEndian.PutUint64(data, 42)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping header:", err)
+	}
+
+	s, err := bf.Snapshot()
+	if err != nil {
+		t.Fatal("Error while creating snapshot:", err)
+	}
+	for i, block := range blocks {
+		writeBlockValue(bf, block, uint64(i+10), t)
+	}
+	err = bf.MapHeader(func(data []byte, contentType uint32) error {
+		binary.LittleEndian.PutUint64(data, 43)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping header:", err)
+	}
+	// freed blocks are held back from reuse, while the snapshot is open
+	if err := bf.FreeBlock(blocks[1]); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	if block == blocks[1] {
+		t.Error("freed block was reused while a snapshot is open")
+	}
+	writeBlockValue(bf, block, 99, t)
+
+	if n := s.NumBlocks(); n != 4 {
+		t.Error("snapshot has", n, "blocks, expected 4")
+	}
+	for i, block := range blocks {
+		if val := readSnapshotValue(s, block, t); val != uint64(i+1) {
+			t.Error("snapshot sees", val, "in block", block, "expected", i+1)
+		}
+	}
+	if err := s.MapBlock(block, func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error when mapping a block allocated after the snapshot")
+	}
+	err = s.MapHeader(func(data []byte, contentType uint32) error {
+		if val := binary.LittleEndian.Uint64(data); val != 42 {
+			t.Error("snapshot sees", val, "in the header, expected 42")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping header of snapshot:", err)
+	}
+	if err := bf.VerifyBlock(blocks[0]); err == nil {
+		t.Error("expected a checksum mismatch after changing a sealed block")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("Error while closing snapshot:", err)
+	}
+	if err := s.MapBlock(blocks[0], func([]byte) error { return nil }); err != ErrSnapshotClosed {
+		t.Error("expected ErrSnapshotClosed, got", err)
+	}
+	block, err = bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	if block != blocks[1] {
+		t.Error("allocated block", block, "expected the released block", blocks[1])
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	blocks, err := bf.AllocateBlocks(8)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(1); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// every generation writes the same value to all blocks
+			for _, block := range blocks {
+				err := bf.MapBlock(block, func(data []byte) error {
+					binary.LittleEndian.PutUint64(data, i)
+					return nil
+				})
+				if err != nil {
+					t.Error("Error while mapping block", block, err)
+					return
+				}
+			}
+			if block, err := bf.AllocateBlock(); err != nil {
+				t.Error("Error while allocating block:", err)
+			} else if err := bf.FreeBlock(block); err != nil {
+				t.Error("Error while freeing block:", err)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s, err := bf.Snapshot()
+		if err != nil {
+			t.Fatal("Error while creating snapshot:", err)
+		}
+		values := make(map[uint64]bool)
+		for _, block := range blocks {
+			values[readSnapshotValue(s, block, t)] = true
+		}
+		// a generation may be in progress, when the snapshot is created
+		if len(values) > 2 {
+			t.Error("snapshot sees", len(values), "generations")
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal("Error while closing snapshot:", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestSnapshotClosedByBlockFile(t *testing.T) {
+	mapper := NewMemoryMapper(64)
+	bf, err := CreateBlockFileInMapperWithSize(mapper, 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	blocks, err := bf.AllocateBlocks(2)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	s, err := bf.Snapshot()
+	if err != nil {
+		t.Fatal("Error while creating snapshot:", err)
+	}
+	if err := bf.FreeBlock(blocks[0]); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	// the held block is freed, when the block-file is closed
+	closeBF(bf, t)
+	if err := s.MapBlock(blocks[1], func([]byte) error { return nil }); err != ErrSnapshotClosed {
+		t.Error("expected ErrSnapshotClosed, got", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error("Error while closing snapshot:", err)
+	}
+	bf, err = OpenBlockFileFromMapper(NewMemoryMapperFromBytes(mapper.Bytes()))
+	if err != nil {
+		t.Fatal("Error while reopening block file:", err)
+	}
+	defer closeBF(bf, t)
+	checkFree(bf, blocks[0], true, t)
+}
@@ -0,0 +1,123 @@
+package mmf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrOldFormat is returned by the functions, that need features of the
+// current BlockFileVersion (like AttachWAL), for block-files of version 1.
+// They have to be migrated by UpgradeBlockFile first.
+var ErrOldFormat = errors.New("BlockFile: old format, the file has to be upgraded")
+
+// UnsupportedFeaturesError is returned when opening a block-file, that uses
+// incompatible features, which are not supported by this package (for
+// example, because the file was created by a newer version).
+type UnsupportedFeaturesError struct {
+	Features uint32 // the unsupported incompatible feature flags
+}
+
+func (e *UnsupportedFeaturesError) Error() string {
+	return fmt.Sprintf("BlockFile: unsupported incompatible features %#x", e.Features)
+}
+
+// checkFileHeader checks the version and the feature flags of the header
+// block.
+func checkFileHeader(hdr *bfFileHeader) error {
+	if version := hdr.version(); version != BlockFileVersion {
+		return fmt.Errorf("BlockFile: unsupported version %d", version)
+	}
+	if unsupported := hdr.incompatFeatures() &^ supportedIncompatFeatures; unsupported != 0 {
+		return &UnsupportedFeaturesError{Features: unsupported}
+	}
+	return nil
+}
+
+// UpgradeBlockFile migrates the block-file that is given as filename in place
+// to the current BlockFileVersion (see UpgradeBlockFileInMapper).
+// It returns an error, if any.
+func UpgradeBlockFile(filename string) error {
+	mf, err := OpenMappedFileWithOptions(filename)
+	if err != nil {
+		return err
+	}
+	if err := UpgradeBlockFileInMapper(mf); err != nil {
+		mf.Close()
+		return err
+	}
+	return mf.Close()
+}
+
+// UpgradeBlockFileInMapper migrates the block-file in the given Mapper in place
+// to the current BlockFileVersion. Files of the current version are left
+// unchanged.
+//
+// Since version 2, the header block has an extended header, so the data
+// section of the header block (see MapHeader) starts 16 bytes later, and is
+// 16 bytes smaller. The data section is moved, which fails, when the last 16
+// bytes of it are in use (not zero). Such files can still be used as files of
+// version 1, without the features of the current version.
+// It returns an error, if any.
+func UpgradeBlockFileInMapper(mapper Mapper) error {
+	if isReadOnlyMapper(mapper) {
+		return ErrReadOnly
+	}
+	var magic, blocksize uint32
+	var order binary.ByteOrder
+	err := mapper.Map(0, bfHeaderSize, func(data []byte) error {
+		hdr, err := bfHeaderFromSlice(data)
+		if err != nil {
+			return err
+		}
+		magic, blocksize, order = hdr.magic(), hdr.blocksize(), hdr.order
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if magic == BlockFileMagic2 {
+		return mapper.Map(0, bfFileHeaderSize, func(data []byte) error {
+			return checkFileHeader(&bfFileHeader{bfHeader: bfHeader{data: data, order: order}})
+		})
+	}
+	return upgradeBlockFileV1(mapper, blocksize)
+}
+
+// upgradeBlockFileV1 migrates a block-file from version 1, which had no
+// extended header (and no high-water mark).
+func upgradeBlockFileV1(mapper Mapper, blocksize uint32) error {
+	if blocksize < uint32(bfFileHeaderSize) {
+		return fmt.Errorf("BlockFile: the blocksize %d is too small for the current version", blocksize)
+	}
+	size := mapperSize(mapper)
+	if size < int64(blocksize) {
+		return fmt.Errorf("BlockFile: mapper is to small for the blocksize specified in the file")
+	}
+	// version 1 handed out all blocks up to the end of the file
+	highWater := (size + int64(blocksize) - 1) / int64(blocksize)
+	if highWater > math.MaxUint32 {
+		return ErrBlockIndexOverflow
+	}
+	if size < highWater*int64(blocksize) {
+		if err := mapper.Truncate(highWater * int64(blocksize)); err != nil {
+			return err
+		}
+	}
+	extension := bfFileHeaderSize - bfHeaderSize
+	return mapper.Map(0, int(blocksize), func(data []byte) error {
+		for _, b := range data[len(data)-extension:] {
+			if b != 0 {
+				return fmt.Errorf("BlockFile: the data section of the header block is too large for the current version")
+			}
+		}
+		hdr, err := bfHeaderFromSlice(data)
+		if err != nil {
+			return err
+		}
+		copy(data[bfFileHeaderSize:], data[bfHeaderSize:len(data)-extension])
+		(&bfFileHeader{bfHeader: *hdr}).initFileHeader(uint64(highWater), 0, 0)
+		return nil
+	})
+}
@@ -0,0 +1,727 @@
+package mmf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// WALSuffix is appended to the filename of a block-file to get the filename
+// of its write-ahead log (see WithWAL).
+const WALSuffix = "-wal"
+
+// ErrNoWAL is returned by BeginWAL, when no write-ahead log is attached to the
+// block-file.
+var ErrNoWAL = errors.New("BlockFile: no write-ahead log attached")
+
+// ErrTxDone is returned by the methods of a transaction, that was already
+// committed or rolled back.
+var ErrTxDone = errors.New("BlockFile: the transaction has already been committed or rolled back")
+
+// ErrNotWAL is returned, when the file with the WALSuffix of a block-file isn't
+// a write-ahead log. Such files are ignored, unless the WithWAL option is
+// used.
+var ErrNotWAL = errors.New("BlockFile: the file is not a write-ahead log")
+
+// ErrRecoveryRequired is returned, when a block-file is opened in read-only
+// mode, while its write-ahead log contains a committed transaction, that was
+// not applied completely. The block-file has to be opened for writing once,
+// which replays the log.
+var ErrRecoveryRequired = errors.New("BlockFile: the write-ahead log has to be replayed")
+
+// The write-ahead log is a sequence of records, which are stored in little
+// endian byte order:
+//
+//	0  magic    uint32 // walMagic
+//	4  kind     uint32 // walBlockRecord or walCommitRecord
+//	8  seq      uint64 // the sequence number of the transaction
+//	16 block    uint64 // the block-index (the number of block records for walCommitRecord)
+//	24 size     uint32 // the size of the payload
+//	28 checksum uint32 // CRC32C of the record (without the checksum) and the payload
+//	32 payload
+//
+// A transaction writes a record with the after image of each block, that it
+// changed, followed by a commit record, and syncs the log, before it writes
+// the blocks to the block-file. So the before images stay untouched in the
+// block-file, until the transaction is durable, and don't have to be logged.
+// After the blocks were written and synced, the first record is invalidated,
+// but the log keeps starting with walMagic, so it can be told apart from
+// other files.
+// The log is replayed, when it contains a complete transaction: all records
+// up to the commit record are valid, and have the same sequence number.
+// Replaying a transaction, that was already applied (partially), is harmless.
+const (
+	walMagic uint32 = 0xB10CA10C
+
+	walBlockRecord  uint32 = 1
+	walCommitRecord uint32 = 2
+
+	walMagicOffset    = 0
+	walKindOffset     = 4
+	walSeqOffset      = 8
+	walBlockOffset    = 16
+	walSizeOffset     = 24
+	walChecksumOffset = 28
+)
+
+var walRecordHeaderSize int = 32
+
+// WALTx is a transaction, that was started by BlockFile.BeginWAL. The changes
+// of a transaction are made to private copies of the blocks, so they are
+// neither visible to MapBlock nor written to the block-file, until Commit is
+// called. Commit makes the changes atomic and durable with the write-ahead
+// log: after a crash, the block-file contains either all or none of them.
+//
+// Only the blocks, that were mapped for writing by the transaction (by
+// MapBlockForWrite, MapHeader, or by the allocation), are logged and written
+// back by Commit, so they must not be changed outside of the transaction in
+// the meantime. Blocks, that are only read, are not copied.
+//
+// There is at most one transaction at a time. A WALTx must not be used by
+// multiple goroutines concurrently.
+type WALTx struct {
+	bf      *BlockFile
+	blocks  map[int][]byte // the private copies of the changed blocks
+	order   []int          // the changed blocks in the order they were copied
+	bitmaps []int          // the bitmap blocks, including the new ones (see WithBitmapAllocator)
+	done    bool
+}
+
+// WithWAL attaches a write-ahead log to a block-file, that is opened by
+// OpenBlockFileWithOptions or created by CreateBlockFileWithOptions (see
+// BlockFile.AttachWAL). The log is stored next to the block-file, in a file
+// with the WALSuffix, which is created when it is missing.
+//
+// The log of a block-file is replayed by OpenBlockFile and
+// OpenBlockFileWithOptions, even without this option.
+func WithWAL() Option {
+	return func(o *options) {
+		o.wal = true
+	}
+}
+
+// AttachWAL replays the committed transaction in the given write-ahead log (if
+// any) to the block-file, and uses the log for the transactions, that are
+// started by BeginWAL. With a write-ahead log, AllocateBlock, AllocateBlocks,
+// FreeBlock and FreeBlocks run in a transaction too, so the free-list stays
+// consistent after a crash. The log is closed by Close, when it is a Closer.
+// It returns ErrOldFormat for block-files of version 1.
+func (bf *BlockFile) AttachWAL(log Mapper) error {
+	if bf.readOnly || isReadOnlyMapper(log) {
+		return ErrReadOnly
+	}
+	if bf.version == 1 {
+		return ErrOldFormat
+	}
+	if bf.hasShadowPaging() {
+		return ErrShadowPaging
+	}
+	if err := bf.replayWAL(log, true); err != nil {
+		return err
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.wal = log
+	return nil
+}
+
+// BeginWAL starts a new transaction (see WALTx). It waits until the current
+// transaction is committed or rolled back, so a goroutine, that holds a
+// transaction, must not start an other one, or call AllocateBlock,
+// AllocateBlocks, FreeBlock or FreeBlocks of the BlockFile.
+// It returns ErrNoWAL, when no write-ahead log is attached (see AttachWAL).
+func (bf *BlockFile) BeginWAL() (*WALTx, error) {
+	if bf.readOnly {
+		return nil, ErrReadOnly
+	}
+	bf.txMu.Lock()
+	bf.mu.RLock()
+	hasWAL := bf.wal != nil
+	bf.mu.RUnlock()
+	if !hasWAL {
+		bf.txMu.Unlock()
+		return nil, ErrNoWAL
+	}
+	return &WALTx{bf: bf, blocks: make(map[int][]byte)}, nil
+}
+
+// hasWAL returns true, when a write-ahead log is attached.
+func (bf *BlockFile) hasWAL() bool {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.wal != nil
+}
+
+// MapBlock maps the block with the given index for reading, and calls the
+// handler (see BlockFile.MapBlock). When the block was changed in the
+// transaction, its private copy is mapped. The handler must not write to the
+// slice (see MapBlockForWrite).
+func (tx *WALTx) MapBlock(block int, handler func([]byte) error) error {
+	return tx.mapBlock(block, tx.readRawBlock, handler)
+}
+
+// MapBlockForWrite maps the private copy of the block with the given index,
+// and calls the handler. The block is copied on the first write, and it is
+// logged and written back by Commit.
+func (tx *WALTx) MapBlockForWrite(block int, handler func([]byte) error) error {
+	return tx.mapBlock(block, tx.mapRawBlock, handler)
+}
+
+func (tx *WALTx) mapBlock(block int, mapRaw func(int, func([]byte) error) error, handler func([]byte) error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if block <= 0 {
+		return fmt.Errorf("can't map block 0. This is the header-block.")
+	}
+	tx.bf.mu.RLock()
+	defer tx.bf.mu.RUnlock()
+	return mapRaw(block, func(data []byte) error {
+		return handler(data[:len(data)-tx.bf.checksumSize()])
+	})
+}
+
+// MapHeader maps the data section of the private copy of the header block,
+// and calls the handler (see BlockFile.MapHeader). The header block is logged
+// and written back by Commit.
+func (tx *WALTx) MapHeader(handler func(data []byte, contentType uint32) error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.bf.mu.RLock()
+	defer tx.bf.mu.RUnlock()
+	return tx.bf.mapHeaderBlockWith(tx.mapRawBlock, 0, func(hdr *bfHeader) error {
+		if handler != nil {
+			return handler(hdr.data[tx.bf.fileHeaderSize():len(hdr.data)-tx.bf.checksumSize()], hdr.contentType())
+		}
+		return nil
+	})
+}
+
+// AllocateBlock allocates a block in the transaction (see
+// BlockFile.AllocateBlock). When the Mapper has to grow, it grows immediately,
+// but the new blocks are only handed out, when the transaction is committed.
+func (tx *WALTx) AllocateBlock() (int, error) {
+	blocks, err := tx.AllocateBlocks(1)
+	if err != nil {
+		return 0, err
+	}
+	return blocks[0], nil
+}
+
+// AllocateBlocks allocates a given number of blocks in the transaction (see
+// AllocateBlock).
+func (tx *WALTx) AllocateBlocks(num int) ([]int, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.bf.mu.Lock()
+	defer tx.bf.mu.Unlock()
+	return tx.bf.allocateBlocks(tx, num)
+}
+
+// AllocateRun allocates the given number of contiguous blocks in the
+// transaction (see BlockFile.AllocateRun).
+func (tx *WALTx) AllocateRun(num int) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	tx.bf.mu.Lock()
+	defer tx.bf.mu.Unlock()
+	return tx.bf.allocateRun(tx, num)
+}
+
+// FreeBlock frees the given block in the transaction (see
+// BlockFile.FreeBlock).
+func (tx *WALTx) FreeBlock(block int) error {
+	_, err := tx.FreeBlocks([]int{block})
+	return err
+}
+
+// FreeBlocks frees the given blocks in the transaction (see FreeBlock).
+func (tx *WALTx) FreeBlocks(blocks []int) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	tx.bf.mu.Lock()
+	defer tx.bf.mu.Unlock()
+	return tx.bf.freeBlocks(tx, blocks)
+}
+
+// Commit writes the changes of the transaction to the write-ahead log, and
+// then to the block-file. With IncompatChecksums, the changed blocks are
+// sealed. When the log was written, but the block-file wasn't, the changes
+// are applied, when the log is replayed.
+// It returns an error, if any.
+func (tx *WALTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.finish()
+	if len(tx.order) == 0 {
+		return nil
+	}
+	bf := tx.bf
+	data := make([][]byte, len(tx.order))
+	for i, block := range tx.order {
+		data[i] = tx.blocks[block]
+		bf.setChecksum(data[i])
+	}
+	bf.mu.RLock()
+	log := bf.wal
+	bf.mu.RUnlock()
+	if err := bf.writeWAL(log, tx.order, data); err != nil {
+		return err
+	}
+	bf.mu.Lock()
+	err := bf.applyBlocks(tx.order, data)
+	if err == nil && tx.bitmaps != nil {
+		bf.bitmaps = tx.bitmaps
+	}
+	bf.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return resetWAL(log)
+}
+
+// Rollback discards the changes of the transaction. Blocks, that were
+// allocated by the transaction, are not handed out. It does nothing, when the
+// transaction was already committed, so it can be deferred.
+func (tx *WALTx) Rollback() {
+	if !tx.done {
+		tx.finish()
+	}
+}
+
+func (tx *WALTx) finish() {
+	tx.done = true
+	tx.blocks = nil
+	tx.order = nil
+	tx.bitmaps = nil
+	tx.bf.txMu.Unlock()
+}
+
+// bitmapBlocks returns the bitmap blocks of the transaction, which are copied
+// from the BlockFile on the first access. The lock of the BlockFile must be
+// held.
+func (tx *WALTx) bitmapBlocks() *[]int {
+	if tx.bitmaps == nil {
+		tx.bitmaps = append([]int{}, tx.bf.bitmaps...)
+	}
+	return &tx.bitmaps
+}
+
+// mapRawBlock maps the private copy of the given block, which is made on the
+// first write. The lock of the BlockFile must be held.
+func (tx *WALTx) mapRawBlock(block int, handler func([]byte) error) error {
+	data, ok := tx.blocks[block]
+	if !ok {
+		data = make([]byte, tx.bf.blocksize)
+		err := tx.readRawBlock(block, func(src []byte) error {
+			copy(data, src)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		tx.blocks[block] = data
+		tx.order = append(tx.order, block)
+	}
+	return handler(data)
+}
+
+// readRawBlock maps the private copy of the given block, when it was changed
+// in the transaction, and the block in the block-file otherwise. The lock of
+// the BlockFile must be held.
+func (tx *WALTx) readRawBlock(block int, handler func([]byte) error) error {
+	if data, ok := tx.blocks[block]; ok {
+		return handler(data)
+	}
+	return tx.bf.readRawBlock(block, func(data []byte) error {
+		if tx.bf.verify {
+			if err := tx.bf.verifyChecksum(block, data); err != nil {
+				return err
+			}
+		}
+		return handler(data)
+	})
+}
+
+// allocateBlocksLogged, allocateRunLogged and freeBlocksLogged run
+// AllocateBlocks, AllocateRun and FreeBlocks in a transaction, when a
+// write-ahead log is attached.
+
+func (bf *BlockFile) allocateBlocksLogged(num int) ([]int, error) {
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	blocks, err := tx.AllocateBlocks(num)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func (bf *BlockFile) allocateRunLogged(num int) (int, error) {
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	first, err := tx.AllocateRun(num)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+func (bf *BlockFile) freeBlocksLogged(blocks []int) (int, error) {
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := tx.FreeBlocks(blocks)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeWAL writes the after images of the given blocks and a commit record to
+// the log, and syncs it.
+func (bf *BlockFile) writeWAL(log Mapper, blocks []int, data [][]byte) error {
+	bf.walSeq++
+	if now := uint64(time.Now().UnixNano()); now > bf.walSeq {
+		// don't reuse the sequence numbers of records from earlier sessions
+		bf.walSeq = now
+	}
+	seq := bf.walSeq
+	recordSize := int64(walRecordHeaderSize) + int64(bf.blocksize)
+	size := int64(len(blocks))*recordSize + int64(walRecordHeaderSize)
+	if size != int64(int(size)) {
+		return fmt.Errorf("BlockFile: the transaction is too large for the write-ahead log")
+	}
+	if mapperSize(log) < size {
+		if err := log.Truncate(size); err != nil {
+			return err
+		}
+	}
+	err := log.Map(0, int(size), func(buf []byte) error {
+		off := 0
+		for i, block := range blocks {
+			off += putWALRecord(buf[off:], walBlockRecord, seq, uint64(block), data[i])
+		}
+		putWALRecord(buf[off:], walCommitRecord, seq, uint64(len(blocks)), nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return syncMapperRange(log, 0, int(size))
+}
+
+// applyBlocks writes the given blocks to the Mapper, and syncs them. The lock
+// must be held.
+func (bf *BlockFile) applyBlocks(blocks []int, data [][]byte) error {
+	end := int64(0)
+	for _, block := range blocks {
+		off, err := bf.blockOffset(block)
+		if err != nil {
+			return err
+		}
+		if off+int64(bf.blocksize) > end {
+			end = off + int64(bf.blocksize)
+		}
+	}
+	if mapperSize(bf.mapper) < end {
+		if err := bf.mapper.Truncate(end); err != nil {
+			return err
+		}
+	}
+	for i, block := range blocks {
+		err := bf.mapRawBlock(block, func(dst []byte) error {
+			copy(dst, data[i])
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		off, _ := bf.blockOffset(block)
+		if err := syncMapperRange(bf.mapper, off, int(bf.blocksize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayWAL applies the committed transaction in the log (if any). With
+// reset, the log is invalidated afterwards.
+func (bf *BlockFile) replayWAL(log Mapper, reset bool) error {
+	blocks, data, err := bf.readWAL(log)
+	if err != nil || blocks == nil {
+		return err
+	}
+	bf.mu.Lock()
+	err = bf.applyBlocks(blocks, data)
+	if err == nil && bf.hasBitmap() {
+		err = bf.loadBitmaps(bf)
+	}
+	bf.mu.Unlock()
+	if err != nil || !reset {
+		return err
+	}
+	return resetWAL(log)
+}
+
+// readWAL returns the blocks and their after images of the committed
+// transaction in the log. It returns nil, when there is none.
+func (bf *BlockFile) readWAL(log Mapper) ([]int, [][]byte, error) {
+	size := mapperSize(log)
+	if size < int64(walRecordHeaderSize) {
+		return nil, nil, nil
+	}
+	if size != int64(int(size)) {
+		return nil, nil, fmt.Errorf("BlockFile: the write-ahead log is too large")
+	}
+	var blocks []int
+	var data [][]byte
+	committed := false
+	err := log.Map(0, int(size), func(buf []byte) error {
+		var seq uint64
+		for off := 0; ; {
+			kind, recordSeq, block, payload, ok := parseWALRecord(buf[off:])
+			if !ok || (off > 0 && recordSeq != seq) {
+				// torn or stale record: the transaction was not committed
+				return nil
+			}
+			seq = recordSeq
+			switch kind {
+			case walCommitRecord:
+				committed = block == uint64(len(blocks))
+				return nil
+			case walBlockRecord:
+				if len(payload) != int(bf.blocksize) {
+					return fmt.Errorf("BlockFile: the blocksize of the write-ahead log does not match")
+				}
+				index, err := bf.blockIndex(block)
+				if err != nil {
+					return err
+				}
+				blocks = append(blocks, index)
+				data = append(data, append([]byte(nil), payload...))
+			default:
+				return nil
+			}
+			off += walRecordHeaderSize + len(payload)
+		}
+	})
+	if err != nil || !committed {
+		return nil, nil, err
+	}
+	return blocks, data, nil
+}
+
+// resetWAL invalidates the first record of the log, so it isn't replayed.
+// The magic is kept (or written to a new log).
+func resetWAL(log Mapper) error {
+	err := log.Map(0, walSeqOffset, func(buf []byte) error {
+		binary.LittleEndian.PutUint32(buf[walMagicOffset:], walMagic)
+		binary.LittleEndian.PutUint32(buf[walKindOffset:], 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return syncMapperRange(log, 0, walSeqOffset)
+}
+
+// checkWALFile returns an error, when the file with the given name exists,
+// but isn't a write-ahead log (it doesn't start with walMagic). Empty files
+// are accepted.
+func checkWALFile(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var magic [4]byte
+	if n, err := io.ReadFull(f, magic[:]); n == 0 && err == io.EOF {
+		return nil
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != walMagic {
+		return ErrNotWAL
+	}
+	return nil
+}
+
+// putWALRecord writes a record to the beginning of buf, and returns its size.
+func putWALRecord(buf []byte, kind uint32, seq uint64, block uint64, payload []byte) int {
+	le := binary.LittleEndian
+	le.PutUint32(buf[walMagicOffset:], walMagic)
+	le.PutUint32(buf[walKindOffset:], kind)
+	le.PutUint64(buf[walSeqOffset:], seq)
+	le.PutUint64(buf[walBlockOffset:], block)
+	le.PutUint32(buf[walSizeOffset:], uint32(len(payload)))
+	copy(buf[walRecordHeaderSize:], payload)
+	le.PutUint32(buf[walChecksumOffset:], walRecordChecksum(buf[:walRecordHeaderSize+len(payload)]))
+	return walRecordHeaderSize + len(payload)
+}
+
+// parseWALRecord reads the record at the beginning of buf. It returns false,
+// when there is no valid record.
+func parseWALRecord(buf []byte) (kind uint32, seq uint64, block uint64, payload []byte, ok bool) {
+	le := binary.LittleEndian
+	if len(buf) < walRecordHeaderSize || le.Uint32(buf[walMagicOffset:]) != walMagic {
+		return 0, 0, 0, nil, false
+	}
+	size := int64(le.Uint32(buf[walSizeOffset:]))
+	if size > int64(len(buf)-walRecordHeaderSize) {
+		return 0, 0, 0, nil, false
+	}
+	record := buf[:walRecordHeaderSize+int(size)]
+	if walRecordChecksum(record) != le.Uint32(buf[walChecksumOffset:]) {
+		return 0, 0, 0, nil, false
+	}
+	return le.Uint32(buf[walKindOffset:]), le.Uint64(buf[walSeqOffset:]), le.Uint64(buf[walBlockOffset:]), record[walRecordHeaderSize:], true
+}
+
+// walRecordChecksum computes the checksum of a record, without its checksum
+// field.
+func walRecordChecksum(record []byte) uint32 {
+	crc := crc32.Checksum(record[:walChecksumOffset], crc32cTable)
+	return crc32.Update(crc, crc32cTable, record[walRecordHeaderSize:])
+}
+
+// syncMapperRange syncs the given range, when the Mapper supports it.
+func syncMapperRange(mapper Mapper, off int64, length int) error {
+	if syncer, ok := mapper.(syncMapper); ok {
+		return syncer.SyncRange(off, length, false)
+	}
+	return nil
+}
+
+// recoverWAL replays the write-ahead log of the block-file with the given
+// filename, when there is one. With the WithWAL option, the log is attached
+// (and created, when it is missing). For read-only block-files, it only checks
+// that there is no committed transaction, and for private mappings, the log
+// is replayed to the private mapping, and is left untouched. A file with the
+// WALSuffix, that isn't a write-ahead log, is ignored, or rejected with the
+// WithWAL option.
+func (bf *BlockFile) recoverWAL(filename string, o *options) error {
+	name := filename + WALSuffix
+	private := o.private
+	if o.wal && (bf.readOnly || private) {
+		return fmt.Errorf("BlockFile: WithWAL requires a writable, shared mapping")
+	}
+	if err := checkWALFile(name); err == ErrNotWAL && !o.wal {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() == 0 {
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !o.wal {
+			return nil
+		}
+		// a new log needs space for a record header, because empty files
+		// can't be mapped
+		log, err := OpenMappedFileWithOptions(name, CreateIfMissing(), WithSize(int64(walRecordHeaderSize)))
+		if err != nil {
+			return err
+		}
+		if err := resetWAL(log); err != nil {
+			log.Close()
+			return err
+		}
+		return bf.attachWALFile(log)
+	}
+	if bf.readOnly || private {
+		log, err := OpenMappedFileReadOnly(name)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+		if bf.readOnly {
+			blocks, _, err := bf.readWAL(log)
+			if err == nil && blocks != nil {
+				err = ErrRecoveryRequired
+			}
+			return err
+		}
+		return bf.replayWAL(log, false)
+	}
+	log, err := OpenMappedFile(name)
+	if err != nil {
+		return err
+	}
+	if !o.wal {
+		defer log.Close()
+		return bf.replayWAL(log, true)
+	}
+	return bf.attachWALFile(log)
+}
+
+func (bf *BlockFile) attachWALFile(log *MappedFile) error {
+	if err := bf.AttachWAL(log); err != nil {
+		log.Close()
+		return err
+	}
+	return nil
+}
+
+// createWAL creates (or resets) the write-ahead log of a block-file, that is
+// created (or replaced) with the given filename, so the log of a replaced
+// block-file is not replayed to the new one. An existing file, that isn't a
+// write-ahead log, is left untouched, and ErrNotWAL is returned.
+func createWAL(filename string) (*MappedFile, error) {
+	name := filename + WALSuffix
+	if err := checkWALFile(name); err != nil {
+		return nil, err
+	}
+	log, err := OpenMappedFileWithOptions(name, CreateIfMissing(), TruncateExisting(), WithSize(int64(walRecordHeaderSize)))
+	if err != nil {
+		return nil, err
+	}
+	if err := resetWAL(log); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// closeWAL closes the write-ahead log, when it is a Closer. The lock must be
+// held.
+func (bf *BlockFile) closeWAL() error {
+	if bf.wal == nil {
+		return nil
+	}
+	closable, ok := bf.wal.(io.Closer)
+	bf.wal = nil
+	if ok {
+		return closable.Close()
+	}
+	return nil
+}
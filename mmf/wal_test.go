@@ -0,0 +1,358 @@
+package mmf_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+// crashingMapper simulates a crash, by failing all calls to Map, when crashed
+// is set.
+type crashingMapper struct {
+	*MemoryMapper
+	crashed bool
+}
+
+func (m *crashingMapper) Map(off int64, length int, handler func([]byte) error) error {
+	if m.crashed {
+		return errors.New("crashed")
+	}
+	return m.MemoryMapper.Map(off, length, handler)
+}
+
+func TestWALTx(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := bf.BeginWAL(); err != ErrNoWAL {
+		t.Error("expected ErrNoWAL, got", err)
+	}
+	if err := bf.AttachWAL(NewMemoryMapper(0)); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	block, err := tx.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	err = tx.MapBlockForWrite(block, func(data []byte) error {
+		copy(data, "hello")
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping block:", err)
+	}
+	// the changes are not visible before the commit
+	if n, _ := bf.NumBlocks(); n != 1 {
+		t.Error("the allocation is visible before the commit", n)
+	}
+	bf.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) == "hello" {
+			t.Error("the change is visible before the commit")
+		}
+		return nil
+	})
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Error("expected ErrTxDone, got", err)
+	}
+	if n, _ := bf.NumBlocks(); n != 2 {
+		t.Error("unexpected number of blocks after the commit", n)
+	}
+	bf.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) != "hello" {
+			t.Error("the change is not visible after the commit")
+		}
+		return nil
+	})
+
+	// rolled back changes are discarded
+	tx, err = bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	if err := tx.FreeBlock(block); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	if _, err := tx.AllocateBlocks(3); err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	tx.Rollback()
+	if n, _ := bf.NumBlocks(); n != 2 {
+		t.Error("unexpected number of blocks after the rollback", n)
+	}
+	// AllocateBlock and FreeBlock use transactions as well
+	if err := bf.FreeBlock(block); err != nil {
+		t.Fatal("Error while freeing block:", err)
+	}
+	if block2, err := bf.AllocateBlock(); err != nil || block2 != block {
+		t.Error("Error while allocating block:", block2, err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	mapper := &crashingMapper{MemoryMapper: NewMemoryMapper(64)}
+	bf, err := CreateBlockFileInMapperWithSize(mapper, 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	log := NewMemoryMapper(0)
+	if err := bf.AttachWAL(log); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	blocks, err := tx.AllocateBlocks(2)
+	if err != nil {
+		t.Fatal("Error while allocating blocks:", err)
+	}
+	for _, block := range blocks {
+		tx.MapBlockForWrite(block, func(data []byte) error {
+			copy(data, "hello")
+			return nil
+		})
+	}
+	// crash after the log was written
+	mapper.crashed = true
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected an error from the crashed mapper")
+	}
+	mapper.crashed = false
+	committedLog := append([]byte(nil), log.Bytes()...)
+
+	// a torn commit record is not replayed
+	tornLog := append([]byte(nil), committedLog...)
+	tornLog[len(tornLog)-1] ^= 1
+	bf2, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if err := bf2.AttachWAL(NewMemoryMapperFromBytes(tornLog)); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+	if n, _ := bf2.NumBlocks(); n != 1 {
+		t.Error("the torn transaction was replayed", n)
+	}
+
+	bf3, err := OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	log3 := NewMemoryMapperFromBytes(committedLog)
+	if err := bf3.AttachWAL(log3); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+	if n, _ := bf3.NumBlocks(); n != 3 {
+		t.Error("the committed transaction was not replayed", n)
+	}
+	for _, block := range blocks {
+		bf3.MapBlock(block, func(data []byte) error {
+			if string(data[:5]) != "hello" {
+				t.Error("the change was not replayed in block", block)
+			}
+			return nil
+		})
+	}
+	// the log is reset after the replay (the kind of the first record)
+	if log3.Bytes()[4] != 0 {
+		t.Error("the log was not reset")
+	}
+}
+
+func TestBlockFileWithWAL(t *testing.T) {
+	const filename = "bftest11.tmp"
+	defer os.Remove(filename)
+	defer os.Remove(filename + WALSuffix)
+	bf, err := CreateBlockFileWithOptions(filename, 64, WithWAL())
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	if _, err := os.Stat(filename + WALSuffix); err != nil {
+		t.Error("the log was not created:", err)
+	}
+	if _, err := bf.AllocateBlock(); err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatal("Error while closing block file:", err)
+	}
+
+	// prepare a log with a committed transaction, that was not applied
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := &crashingMapper{MemoryMapper: NewMemoryMapperFromBytes(data)}
+	bf, err = OpenBlockFileFromMapper(mapper)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	log := NewMemoryMapper(0)
+	if err := bf.AttachWAL(log); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	block, err := tx.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	tx.MapBlockForWrite(block, func(data []byte) error {
+		copy(data, "hello")
+		return nil
+	})
+	mapper.crashed = true
+	tx.Commit()
+	if err := os.WriteFile(filename+WALSuffix, log.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenBlockFileReadOnly(filename); err != ErrRecoveryRequired {
+		t.Error("expected ErrRecoveryRequired, got", err)
+	}
+	bf, err = OpenBlockFile(filename)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if n, _ := bf.NumBlocks(); n != 3 {
+		t.Error("the committed transaction was not replayed", n)
+	}
+	bf.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) != "hello" {
+			t.Error("the change was not replayed")
+		}
+		return nil
+	})
+	closeBF(bf, t)
+	bf, err = OpenBlockFileReadOnly(filename)
+	if err != nil {
+		t.Fatal("Error while opening the recovered block file:", err)
+	}
+	closeBF(bf, t)
+}
+
+func TestWALTxReadOnlyBlocks(t *testing.T) {
+	bf, err := CreateBlockFileInMapperWithSize(NewMemoryMapper(64), 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	log := NewMemoryMapper(0)
+	if err := bf.AttachWAL(log); err != nil {
+		t.Fatal("Error while attaching the log:", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+
+	tx, err := bf.BeginWAL()
+	if err != nil {
+		t.Fatal("Error while starting transaction:", err)
+	}
+	defer tx.Rollback()
+	tx.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) == "hello" {
+			t.Error("unexpected content")
+		}
+		return nil
+	})
+	// a block, that was only read by the transaction, can be changed outside
+	// of it
+	bf.MapBlock(block, func(data []byte) error {
+		copy(data, "hello")
+		return nil
+	})
+	tx.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) != "hello" {
+			t.Error("the block was copied by MapBlock")
+		}
+		return nil
+	})
+	if _, err := tx.AllocateBlock(); err != nil {
+		t.Fatal("Error while allocating block:", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Error while committing:", err)
+	}
+	bf.MapBlock(block, func(data []byte) error {
+		if string(data[:5]) != "hello" {
+			t.Error("the block, that was only read, was written back")
+		}
+		return nil
+	})
+	// only the header block and the new block are logged
+	if size := len(log.Bytes()); size > 3*(32+64) {
+		t.Error("unexpected size of the log", size)
+	}
+}
+
+func TestBlockFileWALSidecar(t *testing.T) {
+	const filename = "bftest13.tmp"
+	defer os.Remove(filename)
+	defer os.Remove(filename + WALSuffix)
+	if err := os.WriteFile(filename+WALSuffix, []byte("not a log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkSidecar := func() {
+		data, err := os.ReadFile(filename + WALSuffix)
+		if err != nil || string(data) != "not a log" {
+			t.Error("the unrelated file was changed:", string(data), err)
+		}
+	}
+
+	bf, err := CreateBlockFileWithSize(filename, 64)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	closeBF(bf, t)
+	checkSidecar()
+	if _, err := CreateBlockFileWithOptions(filename, 64, WithWAL()); err != ErrNotWAL {
+		t.Error("expected ErrNotWAL, got", err)
+	}
+	checkSidecar()
+	bf, err = OpenBlockFile(filename)
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	closeBF(bf, t)
+	if _, err := OpenBlockFileWithOptions(filename, WithWAL()); err != ErrNotWAL {
+		t.Error("expected ErrNotWAL, got", err)
+	}
+	checkSidecar()
+
+	// an existing log is reset
+	if err := os.Remove(filename + WALSuffix); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		bf, err = CreateBlockFileWithOptions(filename, 64, WithWAL())
+		if err != nil {
+			t.Fatal("Error while creating block file:", err)
+		}
+		if _, err := bf.AllocateBlock(); err != nil {
+			t.Fatal("Error while allocating block:", err)
+		}
+		closeBF(bf, t)
+	}
+	bf, err = OpenBlockFileWithOptions(filename, WithWAL())
+	if err != nil {
+		t.Fatal("Error while opening block file:", err)
+	}
+	if n, _ := bf.NumBlocks(); n != 2 {
+		t.Error("unexpected number of blocks", n)
+	}
+	closeBF(bf, t)
+}
@@ -0,0 +1,372 @@
+package mmf
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+const (
+	// DefaultWindowSize is the window size that is used by
+	// OpenWindowedMappedFile, when no window size is given.
+	DefaultWindowSize = 64 << 20
+	// DefaultMaxWindows is the number of windows that are kept mapped by
+	// OpenWindowedMappedFile, when no maximum is given.
+	DefaultMaxWindows = 16
+)
+
+// WindowedMappedFile is a Mapper that doesn't map the whole file at once.
+// Instead, it maps fixed-size windows of the file on demand, and keeps the
+// most recently used windows mapped. This allows to access files that are
+// larger than the address space (for example on 32-bit platforms).
+// Map can be called concurrently by multiple goroutines.
+type WindowedMappedFile struct {
+	windowSection
+	mu         sync.Mutex // protects the fields below, but is not held while a Map handler runs
+	file       *os.File
+	size       int64
+	prot       Protection
+	populate   bool
+	prealloc   bool
+	windowSize int
+	maxWindows int
+	windows    map[int64]*window
+	lru        *list.List           // of *window, the most recently used first
+	views      map[*window]struct{} // the temporary views, that are in use by a Map handler
+}
+
+type window struct {
+	off  int64
+	data []byte
+	pins int
+	elem *list.Element
+}
+
+// OpenWindowedMappedFile opens a file, which is mapped in windows of the
+// given size on demand (see WindowedMappedFile). The window size is rounded
+// up to a multiple of the allocation granularity of the platform. At most
+// maxWindows windows are kept mapped, as long as they are not in use by a Map
+// handler. The options are handled like by OpenMappedFileWithOptions, but
+// the Private and ReserveAddressSpace options are not supported.
+// It returns an error, if any.
+func OpenWindowedMappedFile(filename string, windowSize int, maxWindows int, opts ...Option) (*WindowedMappedFile, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if o.private || o.reserve != 0 {
+		return nil, fmt.Errorf("WindowedMappedFile: private mappings and reserved address space are not supported")
+	}
+	if windowSize <= 0 {
+		windowSize = DefaultWindowSize
+	}
+	if maxWindows <= 0 {
+		maxWindows = DefaultMaxWindows
+	}
+	granularity := allocationGranularity()
+	windowSize = (windowSize + granularity - 1) / granularity * granularity
+	f, err := o.openFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if o.size != -1 {
+		if err := growFile(f, size, o.size, o.preallocate); err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = o.size
+	}
+	wf := &WindowedMappedFile{
+		file:       f,
+		size:       size,
+		prot:       o.prot,
+		populate:   o.populate,
+		prealloc:   o.preallocate,
+		windowSize: windowSize,
+		maxWindows: maxWindows,
+		windows:    make(map[int64]*window),
+		lru:        list.New(),
+		views:      make(map[*window]struct{}),
+	}
+	if err := wf.openSection(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	runtime.SetFinalizer(wf, (*WindowedMappedFile).Close)
+	return wf, nil
+}
+
+// Close unmaps all windows and closes the File. It fails, when a window or a
+// temporary view is in use by a Map handler.
+// It returns an error, if any.
+func (wf *WindowedMappedFile) Close() error {
+	if wf == nil {
+		return nil
+	}
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	if wf.file == nil {
+		return nil
+	}
+	if err := wf.unmapWindows(0); err != nil {
+		return err
+	}
+	if err := wf.closeSection(); err != nil {
+		return err
+	}
+	file := wf.file
+	wf.file = nil
+	runtime.SetFinalizer(wf, nil)
+	return file.Close()
+}
+
+// Name returns the name of the file as presented to OpenWindowedMappedFile.
+func (wf *WindowedMappedFile) Name() string {
+	if wf != nil && wf.file != nil {
+		return wf.file.Name()
+	} else {
+		return ""
+	}
+}
+
+// ReadOnly returns true, if the file was opened in read-only mode.
+func (wf *WindowedMappedFile) ReadOnly() bool {
+	return wf != nil && wf.prot&ProtWrite == 0
+}
+
+// WindowSize returns the size of a single window.
+func (wf *WindowedMappedFile) WindowSize() int {
+	return wf.windowSize
+}
+
+// Size64 returns the size of the file.
+func (wf *WindowedMappedFile) Size64() int64 {
+	if wf == nil {
+		return 0
+	}
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	if wf.file == nil {
+		return 0
+	}
+	return wf.size
+}
+
+// Size returns the size of the file. When the size does not fit into an int,
+// the largest int is returned (see Size64).
+func (wf *WindowedMappedFile) Size() int {
+	size := wf.Size64()
+	if size != int64(int(size)) {
+		return int(^uint(0) >> 1)
+	}
+	return int(size)
+}
+
+// Truncate changes the size of the file. Windows that are affected by the
+// change are unmapped (when shrinking, all windows are unmapped). It fails,
+// when an affected window or temporary view is in use by a Map handler.
+// It returns an error, if any.
+func (wf *WindowedMappedFile) Truncate(size int64) error {
+	if wf == nil {
+		return errors.New("WindowedMappedFile: closed")
+	}
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	if wf.file == nil {
+		return errors.New("WindowedMappedFile: closed")
+	}
+	if wf.prot&ProtWrite == 0 {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return fmt.Errorf("WindowedMappedFile: requested file size is negative")
+	}
+	var from int64
+	if size >= wf.size {
+		from = wf.size / int64(wf.windowSize) * int64(wf.windowSize)
+	}
+	if err := wf.unmapWindows(from); err != nil {
+		return err
+	}
+	if err := wf.closeSection(); err != nil {
+		return err
+	}
+	if err := growFile(wf.file, wf.size, size, wf.prealloc); err != nil {
+		wf.openSection()
+		return err
+	}
+	wf.size = size
+	return wf.openSection()
+}
+
+// Sync tells the operating system to write the changes of all mapped windows
+// back to the file.
+// It returns an error, if any.
+func (wf *WindowedMappedFile) Sync() error {
+	if wf == nil {
+		return errors.New("WindowedMappedFile: closed")
+	}
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	if wf.file == nil {
+		return errors.New("WindowedMappedFile: closed")
+	}
+	if wf.prot&ProtWrite == 0 {
+		return nil
+	}
+	for _, w := range wf.windows {
+		if err := wf.syncView(w.data); err != nil {
+			return err
+		}
+	}
+	return wf.syncFile()
+}
+
+// Map calls the given handler with a slice at the given range. When the range
+// is inside of a single window, the window is mapped (if it isn't already)
+// and kept mapped for later calls. Otherwise, a temporary view of the range is
+// mapped for the handler. The slice is only valid until the handler returns.
+// For empty ranges, nothing is mapped, and the handler gets an empty slice.
+func (wf *WindowedMappedFile) Map(off int64, length int, handler func([]byte) error) error {
+	if wf == nil {
+		return errors.New("WindowedMappedFile: closed")
+	}
+	wf.mu.Lock()
+	if wf.file == nil {
+		wf.mu.Unlock()
+		return errors.New("WindowedMappedFile: closed")
+	}
+	if off < 0 || length < 0 || wf.size < off+int64(length) {
+		wf.mu.Unlock()
+		return fmt.Errorf("WindowedMappedFile: invalid Map offset %d", off)
+	}
+	if length == 0 {
+		// an empty range at the end of the file can't be mapped
+		wf.mu.Unlock()
+		return handler([]byte{})
+	}
+	windowOff := off / int64(wf.windowSize) * int64(wf.windowSize)
+	if off+int64(length) > windowOff+int64(wf.windowSize) {
+		return wf.mapTemporary(off, length, handler)
+	}
+	w, err := wf.window(windowOff)
+	if err != nil {
+		wf.mu.Unlock()
+		return err
+	}
+	w.pins++
+	wf.mu.Unlock()
+	defer func() {
+		wf.mu.Lock()
+		w.pins--
+		wf.mu.Unlock()
+	}()
+	start := int(off - windowOff)
+	return handler(w.data[start : start+length])
+}
+
+// mapTemporary maps a view for a range that spans multiple windows. It is
+// called with the lock held, which is released while the handler runs. Like
+// a window, the view is pinned in the meantime, so the file isn't shrunk or
+// closed under it. The view is released, even when the handler panics.
+func (wf *WindowedMappedFile) mapTemporary(off int64, length int, handler func([]byte) error) (err error) {
+	granularity := int64(allocationGranularity())
+	viewOff := off / granularity * granularity
+	viewLength := off + int64(length) - viewOff
+	if viewLength != int64(int(viewLength)) {
+		wf.mu.Unlock()
+		return fmt.Errorf("WindowedMappedFile: requested range is too large")
+	}
+	data, err := wf.mapView(viewOff, int(viewLength))
+	if err != nil {
+		wf.mu.Unlock()
+		return err
+	}
+	view := &window{off: viewOff, data: data, pins: 1}
+	wf.views[view] = struct{}{}
+	wf.mu.Unlock()
+	defer func() {
+		wf.mu.Lock()
+		defer wf.mu.Unlock()
+		delete(wf.views, view)
+		if unmapErr := wf.unmapView(data); err == nil {
+			err = unmapErr
+		}
+	}()
+	start := int(off - viewOff)
+	return handler(data[start : start+length])
+}
+
+// window returns the window at the given offset, and maps it, if it isn't
+// already mapped. When there are too many windows, the least recently used
+// window that is not in use is unmapped.
+func (wf *WindowedMappedFile) window(off int64) (*window, error) {
+	if w, ok := wf.windows[off]; ok {
+		wf.lru.MoveToFront(w.elem)
+		return w, nil
+	}
+	for e := wf.lru.Back(); e != nil && len(wf.windows) >= wf.maxWindows; {
+		w := e.Value.(*window)
+		e = e.Prev()
+		if w.pins == 0 {
+			if err := wf.unmapWindow(w); err != nil {
+				return nil, err
+			}
+		}
+	}
+	length := int64(wf.windowSize)
+	if wf.size-off < length {
+		length = wf.size - off
+	}
+	data, err := wf.mapView(off, int(length))
+	if err != nil {
+		return nil, err
+	}
+	w := &window{off: off, data: data}
+	w.elem = wf.lru.PushFront(w)
+	wf.windows[off] = w
+	return w, nil
+}
+
+func (wf *WindowedMappedFile) unmapWindow(w *window) error {
+	if err := wf.unmapView(w.data); err != nil {
+		return err
+	}
+	wf.lru.Remove(w.elem)
+	delete(wf.windows, w.off)
+	return nil
+}
+
+// unmapWindows unmaps all windows that end after the given offset.
+func (wf *WindowedMappedFile) unmapWindows(from int64) error {
+	for _, w := range wf.windows {
+		if w.off+int64(wf.windowSize) > from && w.pins > 0 {
+			return fmt.Errorf("WindowedMappedFile: window at offset %d is in use", w.off)
+		}
+	}
+	for view := range wf.views {
+		if view.off+int64(len(view.data)) > from {
+			return fmt.Errorf("WindowedMappedFile: view at offset %d is in use", view.off)
+		}
+	}
+	for _, w := range wf.windows {
+		if w.off+int64(wf.windowSize) > from {
+			if err := wf.unmapWindow(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build js || plan9 || wasip1
+// +build js plan9 wasip1
+
+package mmf
+
+// windowSection holds the platform specific state of a WindowedMappedFile.
+type windowSection struct{}
+
+func allocationGranularity() int {
+	return 4096
+}
+
+func (wf *WindowedMappedFile) openSection() error {
+	return ErrNotSupported
+}
+
+func (wf *WindowedMappedFile) closeSection() error {
+	return nil
+}
+
+func (wf *WindowedMappedFile) mapView(off int64, length int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (wf *WindowedMappedFile) unmapView(data []byte) error {
+	return ErrNotSupported
+}
+
+func (wf *WindowedMappedFile) syncView(data []byte) error {
+	return ErrNotSupported
+}
+
+func (wf *WindowedMappedFile) syncFile() error {
+	return ErrNotSupported
+}
@@ -0,0 +1,212 @@
+package mmf_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/HellButcher/go-mmstruct/mmf"
+)
+
+func closeWF(wf *WindowedMappedFile, t *testing.T) {
+	if err := wf.Close(); err != nil {
+		t.Fatal("Error while closing windowed mapped file:", err)
+	}
+}
+
+func writeWF(wf *WindowedMappedFile, off int64, s string, t *testing.T) {
+	err := wf.Map(off, len(s), func(data []byte) error {
+		copy(data, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping offset", off, err)
+	}
+}
+
+func readWF(wf *WindowedMappedFile, off int64, length int, t *testing.T) string {
+	var s string
+	err := wf.Map(off, length, func(data []byte) error {
+		s = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping offset", off, err)
+	}
+	return s
+}
+
+func TestWindowedMappedFile(t *testing.T) {
+	defer os.Remove("test6.tmp")
+	wf, err := OpenWindowedMappedFile("test6.tmp", 1<<16, 2, CreateIfMissing(), WithSize(1<<20))
+	if err != nil {
+		t.Fatal("Error while creating windowed mapped file:", err)
+	}
+	defer closeWF(wf, t)
+	if s := wf.Size64(); s != 1<<20 {
+		t.Error("size mismatch. expected 1MiB, got", s)
+	}
+	ws := int64(wf.WindowSize())
+
+	writeWF(wf, 100, "ABCDE", t)
+	writeWF(wf, 3*ws+100, "FGHIJ", t)
+	writeWF(wf, 5*ws-2, "KLMNO", t) // spans two windows
+	writeWF(wf, 7*ws, "PQRST", t)   // evicts the first window
+	if s := readWF(wf, 100, 5, t); s != "ABCDE" {
+		t.Error("expected ABCDE, got", s)
+	}
+	if s := readWF(wf, 5*ws-2, 5, t); s != "KLMNO" {
+		t.Error("expected KLMNO, got", s)
+	}
+
+	// nested handlers keep their windows mapped
+	err = wf.Map(3*ws+100, 5, func(outer []byte) error {
+		writeWF(wf, 9*ws, "UVWXY", t)
+		writeWF(wf, 11*ws, "Z", t)
+		if string(outer) != "FGHIJ" {
+			t.Error("expected FGHIJ, got", string(outer))
+		}
+		if err := wf.Truncate(ws); err == nil {
+			t.Error("expected an error when shrinking during a Map handler")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping", err)
+	}
+
+	// temporary views of ranges, that span two windows, are pinned as well
+	err = wf.Map(5*ws-2, 5, func(view []byte) error {
+		if err := wf.Truncate(ws); err == nil {
+			t.Error("expected an error when shrinking during a Map handler")
+		}
+		if err := wf.Close(); err == nil {
+			t.Error("expected an error when closing during a Map handler")
+		}
+		if string(view) != "KLMNO" {
+			t.Error("expected KLMNO, got", string(view))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error while mapping", err)
+	}
+
+	if err := wf.Map(1<<20-2, 5, func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error when mapping out of bounds")
+	}
+	// an empty range at the end of the file (on a window boundary)
+	err = wf.Map(1<<20, 0, func(data []byte) error {
+		if len(data) != 0 {
+			t.Error("expected an empty slice, got", len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Error while mapping an empty range:", err)
+	}
+	if err := wf.Truncate(2 << 20); err != nil {
+		t.Fatal("Error while truncating windowed mapped file:", err)
+	}
+	writeWF(wf, 1<<20-2, "ABCDE", t)
+	if err := wf.Sync(); err != nil {
+		t.Fatal("Error while syncing windowed mapped file:", err)
+	}
+	// the temporary view is released, when the handler panics, so the file
+	// can be shrunk afterwards
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic")
+			}
+		}()
+		wf.Map(5*ws-2, 5, func([]byte) error {
+			panic("handler")
+		})
+	}()
+	if err := wf.Truncate(6 * ws); err != nil {
+		t.Fatal("Error while truncating windowed mapped file:", err)
+	}
+	closeWF(wf, t)
+
+	mf, err := OpenMappedFile("test6.tmp")
+	if err != nil {
+		t.Fatal("Error while opening mapped file:", err)
+	}
+	defer closeMF(mf, t)
+	if s := int64(mf.Size()); s != 6*ws {
+		t.Error("size mismatch. expected", 6*ws, "got", s)
+	}
+	data := mf.Bytes()
+	if s := string(data[100:105]); s != "ABCDE" {
+		t.Error("expected ABCDE, got", s)
+	}
+	if s := string(data[3*ws+100 : 3*ws+105]); s != "FGHIJ" {
+		t.Error("expected FGHIJ, got", s)
+	}
+	if s := string(data[5*ws-2 : 5*ws+3]); s != "KLMNO" {
+		t.Error("expected KLMNO, got", s)
+	}
+}
+
+func TestBlockFileInWindowedMappedFile(t *testing.T) {
+	defer os.Remove("bftest4.tmp")
+	wf, err := OpenWindowedMappedFile("bftest4.tmp", 1<<16, 2, CreateIfMissing(), WithSize(4096))
+	if err != nil {
+		t.Fatal("Error while creating windowed mapped file:", err)
+	}
+	bf, err := CreateBlockFileInMapper(wf)
+	if err != nil {
+		t.Fatal("Error while creating block file:", err)
+	}
+	defer closeBF(bf, t)
+	for n := 1; n < 40; n++ {
+		block, err := bf.AllocateBlock()
+		if err != nil {
+			t.Fatal("Error while allocatin block", n, err)
+		}
+		if block != n {
+			t.Error("unexpected block index. expected ", n, ", got", block)
+		}
+	}
+	if err := bf.FreeBlock(20); err != nil {
+		t.Fatal("Error while freeing block 20", err)
+	}
+	block, err := bf.AllocateBlock()
+	if err != nil {
+		t.Fatal("Error while allocatin block 20", err)
+	}
+	if block != 20 {
+		t.Error("unexpected block index. expected 20, got ", block)
+	}
+}
+
+func TestWindowedMappedFileConcurrentMap(t *testing.T) {
+	defer os.Remove("test13.tmp")
+	wf, err := OpenWindowedMappedFile("test13.tmp", 1<<16, 2, CreateIfMissing(), WithSize(1<<20))
+	if err != nil {
+		t.Fatal("Error while creating windowed mapped file:", err)
+	}
+	defer closeWF(wf, t)
+	ws := int64(wf.WindowSize())
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// more windows are in use than are kept mapped
+				off := int64((g+i)%16)*ws + int64(g)*8
+				err := wf.Map(off, 8, func(data []byte) error {
+					data[0] = byte(g)
+					return nil
+				})
+				if err != nil {
+					t.Error("Error while mapping offset", off, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
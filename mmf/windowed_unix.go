@@ -0,0 +1,62 @@
+//go:build !windows && !js && !plan9 && !wasip1
+// +build !windows,!js,!plan9,!wasip1
+
+package mmf
+
+import (
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+// windowSection holds the platform specific state of a WindowedMappedFile.
+type windowSection struct{}
+
+func allocationGranularity() int {
+	return os.Getpagesize()
+}
+
+func (wf *WindowedMappedFile) openSection() error {
+	return nil
+}
+
+func (wf *WindowedMappedFile) closeSection() error {
+	return nil
+}
+
+func (wf *WindowedMappedFile) mapView(off int64, length int) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if wf.prot&ProtWrite != 0 {
+		prot |= syscall.PROT_WRITE
+	}
+	if wf.prot&ProtExec != 0 {
+		prot |= syscall.PROT_EXEC
+	}
+	flags := syscall.MAP_SHARED
+	if wf.populate {
+		flags |= mapPopulate
+	}
+	data, err := syscall.Mmap(int(wf.file.Fd()), off, length, prot, flags)
+	if err != nil {
+		return nil, os.NewSyscallError("Mmap", err)
+	}
+	return data, nil
+}
+
+func (wf *WindowedMappedFile) unmapView(data []byte) error {
+	if err := syscall.Munmap(data); err != nil {
+		return os.NewSyscallError("Munmap", err)
+	}
+	return nil
+}
+
+func (wf *WindowedMappedFile) syncView(data []byte) error {
+	if err := syscall.Msync(data, syscall.MS_SYNC); err != nil {
+		return os.NewSyscallError("Msync", err)
+	}
+	return nil
+}
+
+func (wf *WindowedMappedFile) syncFile() error {
+	return nil
+}
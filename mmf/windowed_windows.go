@@ -0,0 +1,87 @@
+package mmf
+
+import (
+	"os"
+	"unsafe"
+
+	syscall "golang.org/x/sys/windows"
+)
+
+// windowSection holds the platform specific state of a WindowedMappedFile.
+type windowSection struct {
+	handle syscall.Handle
+}
+
+func allocationGranularity() int {
+	return 64 << 10 // the allocation granularity of all windows versions
+}
+
+func (wf *WindowedMappedFile) access() (prot uint32, access uint32) {
+	exec := wf.prot&ProtExec != 0
+	switch {
+	case wf.prot&ProtWrite == 0 && exec:
+		return syscall.PAGE_EXECUTE_READ, syscall.FILE_MAP_READ | syscall.FILE_MAP_EXECUTE
+	case wf.prot&ProtWrite == 0:
+		return syscall.PAGE_READONLY, syscall.FILE_MAP_READ
+	case exec:
+		return syscall.PAGE_EXECUTE_READWRITE, syscall.FILE_MAP_WRITE | syscall.FILE_MAP_EXECUTE
+	default:
+		return syscall.PAGE_READWRITE, syscall.FILE_MAP_WRITE
+	}
+}
+
+// openSection creates a file mapping object for the current size of the
+// file. Views of an older file mapping object stay valid after it was closed.
+func (wf *WindowedMappedFile) openSection() error {
+	if wf.size == 0 {
+		// empty files can't be mapped
+		return nil
+	}
+	prot, _ := wf.access()
+	handle, err := syscall.CreateFileMapping(syscall.Handle(wf.file.Fd()), nil, prot, 0, 0, nil) // 0,0 := total size of the file
+	if err != nil {
+		return os.NewSyscallError("CreateFileMapping", err)
+	}
+	wf.handle = handle
+	return nil
+}
+
+func (wf *WindowedMappedFile) closeSection() error {
+	if handle := wf.handle; handle != 0 && handle != ^syscall.Handle(0) {
+		wf.handle = 0
+		if err := syscall.CloseHandle(handle); err != nil {
+			return os.NewSyscallError("CloseHandle", err)
+		}
+	}
+	return nil
+}
+
+func (wf *WindowedMappedFile) mapView(off int64, length int) ([]byte, error) {
+	_, access := wf.access()
+	ptr, err := syscall.MapViewOfFile(wf.handle, access, uint32(uint64(off)>>32), uint32(off), uintptr(length))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(ptr)), length), nil
+}
+
+func (wf *WindowedMappedFile) unmapView(data []byte) error {
+	if err := syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0]))); err != nil {
+		return os.NewSyscallError("UnmapViewOfFile", err)
+	}
+	return nil
+}
+
+func (wf *WindowedMappedFile) syncView(data []byte) error {
+	if err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data))); err != nil {
+		return os.NewSyscallError("FlushViewOfFile", err)
+	}
+	return nil
+}
+
+func (wf *WindowedMappedFile) syncFile() error {
+	if err := syscall.FlushFileBuffers(syscall.Handle(wf.file.Fd())); err != nil {
+		return os.NewSyscallError("FlushFileBuffers", err)
+	}
+	return nil
+}